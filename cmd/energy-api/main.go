@@ -4,20 +4,53 @@ import (
 	"context"
 	"fmt"
 	"github.com/orlopau/go-energy/pkg/meter"
-	"github.com/orlopau/go-energy/pkg/sunspec"
 	"github.com/orlopau/go-sma-api/internal/api"
 	"github.com/orlopau/go-sma-api/internal/config"
+	"github.com/orlopau/go-sma-api/internal/energy"
+	"github.com/orlopau/go-sma-api/internal/history"
+	"github.com/orlopau/go-sma-api/internal/metrics"
+	"github.com/orlopau/go-sma-api/internal/modbus"
+	"github.com/orlopau/go-sma-api/internal/mqtt"
 	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/orlopau/go-sma-api/internal/rules"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 const (
-	keyConfigPath      = "config_path"
-	keyConfigPort      = "port"
-	slaveId       byte = 126
+	keyConfigPath               = "config_path"
+	keyConfigPort               = "port"
+	keyHistoryPath              = "history_path"
+	keyHistoryResolutions       = "history_resolutions"
+	keyTotalsPath               = "totals_path"
+	keyReadyMaxAge              = "ready_max_age"
+	keyMQTTBroker               = "mqtt_broker"
+	keyMQTTTopic                = "mqtt_topic"
+	keyMQTTQoS                  = "mqtt_qos"
+	keyMQTTRetain               = "mqtt_retain"
+	keyMQTTClientID             = "mqtt_client_id"
+	keyMQTTUsername             = "mqtt_username"
+	keyMQTTPassword             = "mqtt_password"
+	keyMQTTDiscoveryPrefix      = "mqtt_discovery_prefix"
+	slaveId                byte = 126
+	// defaultFetchInterval is the fetch interval of plants without an energy meter, if none is configured.
+	defaultFetchInterval = time.Second
+	// modbusTimeout is the timeout of connecting to SunSpec devices and of each modbus request.
+	modbusTimeout = 10 * time.Second
+	// actuatorTimeout is the timeout of switching an actuator of a rule.
+	actuatorTimeout = 10 * time.Second
+	// mqttTimeout is the timeout of connecting to the MQTT broker and of each publish.
+	mqttTimeout = 10 * time.Second
+	// shutdownTimeout is the maximum time to wait for open requests on shutdown.
+	shutdownTimeout = 5 * time.Second
 )
 
 func main() {
@@ -34,6 +67,25 @@ func start() error {
 
 	v.SetDefault(keyConfigPath, ".")
 	v.SetDefault(keyConfigPort, 8080)
+	v.SetDefault(keyHistoryPath, "history.db")
+	v.SetDefault(keyHistoryResolutions, history.DefaultResolutions)
+	v.SetDefault(keyTotalsPath, "energy.json")
+	v.SetDefault(keyReadyMaxAge, 30*time.Second)
+	v.SetDefault(keyMQTTTopic, "energy")
+	v.SetDefault(keyMQTTRetain, true)
+	v.SetDefault(keyMQTTClientID, "energy-api")
+	v.SetDefault(keyMQTTDiscoveryPrefix, "homeassistant")
+
+	// cancelled on SIGINT or SIGTERM, which stops fetching and shuts down the server
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("shutting down")
+		cancel()
+	}()
 
 	path := v.GetString(keyConfigPath)
 	confPlants, err := config.ReadPlantsConfig(path)
@@ -41,59 +93,321 @@ func start() error {
 		return errors.Wrap(err, "error reading plants config")
 	}
 
+	m, err := metrics.New(prometheus.DefaultRegisterer)
+	if err != nil {
+		return errors.Wrap(err, "error setting up metrics")
+	}
+
 	log.Println("setting up energy devices")
-	plants, err := createPlants(slaveId, confPlants)
+	ps, err := createPlants(ctx, slaveId, confPlants, m)
 	if err != nil {
 		return errors.Wrap(err, "error setting up plants")
 	}
+	plants := ps.fetchers
+
+	opts := []api.Option{
+		api.WithReadyMaxAge(v.GetDuration(keyReadyMaxAge)),
+		api.WithDevices(ps.devices),
+		api.WithBatteryControl(ps.batteries),
+		api.WithPVControl(ps.pv),
+	}
+	if path := v.GetString(keyHistoryPath); path != "" {
+		resolutions, err := history.ParseResolutions(v.GetString(keyHistoryResolutions))
+		if err != nil {
+			return errors.Wrap(err, "error parsing history resolutions")
+		}
+
+		log.Println("setting up history")
+		store, err := history.OpenBolt(path, resolutions)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		history.Record(ctx, store, subscribers(plants))
+
+		opts = append(opts, api.WithHistory(store))
+	}
+
+	var totals mqtt.EnergyTotaler
+	if path := v.GetString(keyTotalsPath); path != "" {
+		log.Println("setting up energy totals")
+		integrator, err := energy.Open(path)
+		if err != nil {
+			return err
+		}
+		totals = integrator
+		energy.Run(ctx, integrator, subscribers(plants))
+		defer func() {
+			err := integrator.Save()
+			if err != nil {
+				log.Println(errors.Wrap(err, "error saving energy totals"))
+			}
+		}()
+
+		opts = append(opts, api.WithEnergy(integrator))
+	}
+
+	if broker := v.GetString(keyMQTTBroker); broker != "" {
+		qos := v.GetUint(keyMQTTQoS)
+		if qos > 2 {
+			return fmt.Errorf("mqtt qos must be 0, 1 or 2")
+		}
+
+		log.Println("setting up mqtt")
+		prefix := v.GetString(keyMQTTTopic)
+		c := mqtt.Connect(mqtt.Options{
+			Broker:      broker,
+			ClientID:    v.GetString(keyMQTTClientID),
+			Username:    v.GetString(keyMQTTUsername),
+			Password:    v.GetString(keyMQTTPassword),
+			Timeout:     mqttTimeout,
+			StatusTopic: prefix + "/status",
+			QoS:         byte(qos),
+		})
+		defer c.Close()
+
+		devices := make(map[string]mqtt.DeviceLister, len(ps.devices))
+		for k, l := range ps.devices {
+			devices[k] = l
+		}
+
+		publisher := &mqtt.Publisher{
+			Client:          c,
+			Prefix:          prefix,
+			QoS:             byte(qos),
+			Retained:        v.GetBool(keyMQTTRetain),
+			Energy:          totals,
+			DiscoveryPrefix: v.GetString(keyMQTTDiscoveryPrefix),
+			Devices:         devices,
+		}
+		publisher.Run(ctx, subscribers(plants))
+	}
+
+	rs, closeRules, err := createRules(confPlants)
+	if err != nil {
+		return errors.Wrap(err, "error setting up rules")
+	}
+	defer closeRules()
+	if len(rs) > 0 {
+		log.Println("running rules")
+		rules.Run(ctx, rs, subscribers(plants), ps.staleAfter)
+	}
 
 	log.Println("setting up server")
-	server, err := api.NewServer(plants)
+	server, err := api.NewServer(plants, opts...)
 	if err != nil {
 		return err
 	}
 
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%v", v.GetString(keyConfigPort)),
+		Handler: server,
+		// ends streams and websockets on shutdown
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := httpServer.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Println(errors.Wrap(err, "error shutting down server"))
+		}
+	}()
+
 	log.Println("server starting")
-	err = http.ListenAndServe(fmt.Sprintf(":%v", v.GetString(keyConfigPort)), server)
-	if err != nil {
+	err = httpServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		return err
 	}
 
+	// wait for open requests before closing the stores
+	<-shutdown
 	return nil
 }
 
-func createPlants(modbusSlaveId byte, plants map[string]config.Plant) (map[string]api.PlantFetcher, error) {
-	ps := make(map[string]api.PlantFetcher, len(plants))
+// plantSetup contains the plants by name, the controllers only for plants with controllable devices.
+type plantSetup struct {
+	fetchers  map[string]api.PlantFetcher
+	devices   map[string]api.DeviceLister
+	batteries map[string]api.BatteryController
+	pv        map[string]api.PVLimiter
+	// staleAfter contains the age after which summaries of each plant are stale.
+	staleAfter map[string]time.Duration
+}
 
-	meterListener, err := meter.Listen()
-	if err != nil {
-		return nil, err
+// createPlants returns the continuously fetched plants and their controllers, starting the export controllers of
+// plants with an export limit.
+func createPlants(ctx context.Context, modbusSlaveId byte, plants map[string]config.Plant, m *metrics.Metrics) (
+	*plantSetup, error) {
+	ps := &plantSetup{
+		fetchers:   make(map[string]api.PlantFetcher, len(plants)),
+		devices:    make(map[string]api.DeviceLister, len(plants)),
+		batteries:  make(map[string]api.BatteryController),
+		pv:         make(map[string]api.PVLimiter),
+		staleAfter: make(map[string]time.Duration, len(plants)),
+	}
+
+	var meterListener *meter.EnergyMeter
+
+	dial := func(addr string) (plant.PointReader, error) {
+		log.Printf("connecting to %v", addr)
+		d, err := modbus.DialSunSpec(addr, modbusSlaveId, modbusTimeout)
+		if err != nil {
+			log.Printf("error connecting to %v: %v", addr, err)
+			return nil, err
+		}
+		return d, nil
 	}
 
 	for k, v := range plants {
-		readers := make([]plant.PointReader, len(v.SunSpecAddrs))
+		devices := make([]plant.Device, len(v.SunSpecAddrs))
 		for i, addr := range v.SunSpecAddrs {
-			ssr, err := sunspec.Connect(addr)
-			if err != nil {
-				return nil, err
+			// devices which are offline are connected in the background
+			ssr := plant.Supervise(ctx, addr, dial)
+			devices[i] = plant.Device{
+				Address:  addr,
+				SlaveID:  modbusSlaveId,
+				Reader:   ssr,
+				Capacity: v.BatteryCapacity(addr),
+				Limits:   v.BatteryLimits(addr),
+				// batteries are never limited
+				LimitPower: v.LimitsPV(),
 			}
-			ssr.SetDeviceAddress(modbusSlaveId)
-			readers[i] = ssr
 		}
 
-		// TODO un-export GridMeter, add serial number filter (and therefore a ONE device energymeter) in go-energy
-		em := &plant.GridMeter{
-			EM:           meterListener,
-			SerialNumber: v.EnergyMeterSN,
+		var em plant.GridReader
+		switch v.GridSource() {
+		case config.GridEnergyMeter:
+			if v.EnergyMeterSN == 0 {
+				return nil, fmt.Errorf("plant %v has no energymeter serial number", k)
+			}
+			if meterListener == nil {
+				var err error
+				meterListener, err = meter.Listen()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// TODO un-export GridMeter, add serial number filter (and therefore a ONE device energymeter) in go-energy
+			em = &plant.GridMeter{
+				EM:           meterListener,
+				SerialNumber: v.EnergyMeterSN,
+			}
+		case config.GridSunSpec:
+			// a SunSpec meter is detected among the devices
+		default:
+			return nil, fmt.Errorf("unknown grid source %v of plant %v", v.GridSource(), k)
 		}
 
-		p, err := plant.NewPlant(em, readers...)
+		p, err := plant.NewPlant(em, devices...)
 		if err != nil {
 			return nil, errors.Wrap(err, fmt.Sprintf("error creating plant %v", k))
 		}
 
-		ps[k] = plant.FetchContinuously(context.Background(), p)
+		interval := v.Interval
+		if em == nil && interval == 0 {
+			interval = defaultFetchInterval
+		}
+
+		opts := []plant.FetchOption{plant.WithGracePeriod(v.GracePeriod)}
+		if v.StaleAfter != 0 {
+			opts = append(opts, plant.WithStaleAfter(v.StaleAfter))
+		}
+
+		cfp := plant.FetchContinuously(ctx, m.Instrument(k, p), interval, opts...)
+		ps.fetchers[k] = cfp
+		ps.devices[k] = p
+		ps.staleAfter[k] = cfp.StaleAfter()
+		for _, b := range v.Batteries {
+			if b.Control != nil {
+				ps.batteries[k] = p
+			}
+		}
+		if v.LimitsPV() {
+			ps.pv[k] = p
+		}
+
+		if v.ExportLimit != nil {
+			err := plant.ControlExport(ctx, p, cfp, *v.ExportLimit, interval)
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("error controlling export of plant %v", k))
+			}
+		}
 	}
 
 	return ps, nil
 }
+
+// createRules returns the rules of the plants by name and a function disconnecting from the MQTT brokers of their
+// actuators.
+func createRules(plants config.Plants) (map[string][]*rules.Rule, func(), error) {
+	rs := make(map[string][]*rules.Rule)
+	brokers := make(map[string]*mqtt.Client)
+	closeBrokers := func() {
+		for _, c := range brokers {
+			c.Close()
+		}
+	}
+
+	for k, v := range plants {
+		for _, r := range v.Rules {
+			var a rules.Actuator
+			switch {
+			case r.Webhook != nil:
+				a = &rules.Webhook{
+					URL:    r.Webhook.URL,
+					Method: r.Webhook.Method,
+					Client: &http.Client{Timeout: actuatorTimeout},
+				}
+			case r.MQTT != nil:
+				c, ok := brokers[r.MQTT.Broker]
+				if !ok {
+					c = mqtt.Connect(mqtt.Options{
+						Broker:   r.MQTT.Broker,
+						ClientID: "energy-api-rules",
+						Timeout:  actuatorTimeout,
+					})
+					brokers[r.MQTT.Broker] = c
+				}
+				a = &rules.MQTT{
+					Publisher: c,
+					Topic:     r.MQTT.Topic,
+					On:        r.MQTT.On,
+					Off:       r.MQTT.Off,
+					QoS:       r.MQTT.QoS,
+					Retained:  r.MQTT.Retain,
+				}
+			case r.Modbus != nil:
+				a = &rules.ModbusCoil{
+					Address: r.Modbus.Address,
+					SlaveID: r.Modbus.SlaveID,
+					Coil:    r.Modbus.Coil,
+					Timeout: actuatorTimeout,
+				}
+			}
+
+			rule, err := r.Rule(a)
+			if err != nil {
+				closeBrokers()
+				return nil, nil, errors.Wrap(err, fmt.Sprintf("invalid rule of plant %v", k))
+			}
+			rs[k] = append(rs[k], rule)
+		}
+	}
+
+	return rs, closeBrokers, nil
+}
+
+func subscribers(plants map[string]api.PlantFetcher) map[string]plant.Subscriber {
+	subs := make(map[string]plant.Subscriber, len(plants))
+	for k, p := range plants {
+		subs[k] = p
+	}
+	return subs
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/config"
+	"github.com/orlopau/go-sma-api/internal/modbus"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// modbusTimeout is the timeout of connecting to the battery and of each modbus request.
+const modbusTimeout = 10 * time.Second
+
+func batteryCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "battery",
+		Usage: "controls SunSpec battery inverters",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "set",
+				Usage: "sets charge and discharge limits and the minimum reserve of a battery",
+				UsageText: "energy-cli battery set --addr <addr> [--charge <W>] [--discharge <W>] [--reserve <%>] " +
+					"[--timeout <duration>]",
+				Description: "Sets a setpoint of the battery and keeps it until the timeout or until the command is " +
+					"interrupted, then the setpoint is reverted.\n\n" +
+					" The battery must be configured as controllable in plants.yml, its safety bounds apply to the setpoint.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "path to the directory of plants.yml",
+						Value: ".",
+					},
+					&cli.UintFlag{
+						Name:    "slaveId",
+						Aliases: []string{"id"},
+						Usage:   "slave id to use for modbus connection",
+						Value:   126,
+					},
+					&cli.StringFlag{
+						Name:     "addr",
+						Aliases:  []string{"a"},
+						Usage:    "address of the battery",
+						Required: true,
+					},
+					&cli.Float64Flag{
+						Name:  "charge",
+						Usage: "charge limit in W",
+					},
+					&cli.Float64Flag{
+						Name:  "discharge",
+						Usage: "discharge limit in W",
+					},
+					&cli.Float64Flag{
+						Name:  "reserve",
+						Usage: "minimum reserve SoC in percent",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "time until the setpoint is reverted, defaults to the configured timeout",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					slaveId := c.Uint("slaveId")
+					if slaveId > uint(^byte(0)) {
+						return cli.Exit("slave id must be in range 0 to 254", 1)
+					}
+
+					sp := plant.BatterySetpoint{Timeout: c.Duration("timeout")}
+					if c.IsSet("charge") {
+						v := c.Float64("charge")
+						sp.ChargeLimit = &v
+					}
+					if c.IsSet("discharge") {
+						v := c.Float64("discharge")
+						sp.DischargeLimit = &v
+					}
+					if c.IsSet("reserve") {
+						v := c.Float64("reserve")
+						sp.MinReserve = &v
+					}
+
+					return toExitCode(setBattery(c.String("config"), byte(slaveId), c.String("addr"), sp))
+				},
+			},
+		},
+	}
+}
+
+// setBattery writes the setpoint to the battery and reverts it after its timeout or on SIGINT or SIGTERM.
+func setBattery(configPath string, slaveId byte, addr string, sp plant.BatterySetpoint) error {
+	plants, err := config.ReadPlantsConfig(configPath)
+	if err != nil {
+		return errors.Wrap(err, "error reading plants config")
+	}
+
+	var limits *plant.BatteryLimits
+	for _, p := range plants {
+		if limits = p.BatteryLimits(addr); limits != nil {
+			break
+		}
+	}
+	if limits == nil {
+		return fmt.Errorf("battery %v is not configured as controllable", addr)
+	}
+
+	log.Printf("connecting to %v...", addr)
+	d, err := modbus.DialSunSpec(addr, slaveId, modbusTimeout)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	p, err := plant.NewPlant(nil, plant.Device{Address: addr, SlaveID: slaveId, Reader: d, Limits: limits})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		cancel()
+	}()
+
+	revertAt, err := p.SetBattery(ctx, addr, sp)
+	if err != nil {
+		return err
+	}
+	log.Printf("setpoint active until %v, interrupt to revert it earlier", revertAt.Format(time.RFC3339))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Until(revertAt)):
+	}
+
+	revertCtx, cancelRevert := context.WithTimeout(context.Background(), modbusTimeout)
+	defer cancelRevert()
+
+	err = p.RevertBattery(revertCtx, addr)
+	if err != nil {
+		return errors.Wrap(err, "error reverting setpoint")
+	}
+	log.Println("setpoint reverted")
+	return nil
+}
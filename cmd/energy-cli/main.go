@@ -46,6 +46,8 @@ func main() {
 					return toExitCode(fetch.AddressFetch(byte(slaveId), addrs))
 				},
 			},
+			batteryCommand(),
+			pvCommand(),
 		},
 	}
 
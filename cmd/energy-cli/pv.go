@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/config"
+	"github.com/orlopau/go-sma-api/internal/modbus"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"log"
+)
+
+func pvCommand() *cli.Command {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "path to the directory of plants.yml",
+			Value: ".",
+		},
+		&cli.UintFlag{
+			Name:    "slaveId",
+			Aliases: []string{"id"},
+			Usage:   "slave id to use for modbus connection",
+			Value:   126,
+		},
+		&cli.StringFlag{
+			Name:     "addr",
+			Aliases:  []string{"a"},
+			Usage:    "address of the PV inverter",
+			Required: true,
+		},
+	}
+
+	return &cli.Command{
+		Name:  "pv",
+		Usage: "controls SunSpec PV inverters",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "limit",
+				Usage:     "limits the active power of a PV inverter",
+				UsageText: "energy-cli pv limit --addr <addr> --limit <%> [--timeout <duration>]",
+				Description: "Limits the active power to a percentage of the rated power. The inverter keeps the limit " +
+					"until the timeout or until it is removed.\n\n" +
+					" The plant of the inverter must allow PV limits in plants.yml.",
+				Flags: append(flags,
+					&cli.Float64Flag{
+						Name:     "limit",
+						Usage:    "limit in percent of the rated power",
+						Required: true,
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "time until the inverter reverts the limit, 0 to keep it",
+					},
+				),
+				Action: func(c *cli.Context) error {
+					return toExitCode(withPVPlant(c, func(ctx context.Context, p *plant.Plant, addr string) error {
+						err := p.LimitPV(ctx, addr, c.Float64("limit"), c.Duration("timeout"))
+						if err != nil {
+							return err
+						}
+						log.Printf("limited %v to %v%%", addr, c.Float64("limit"))
+						return nil
+					}))
+				},
+			},
+			{
+				Name:      "unlimit",
+				Usage:     "removes the limit of a PV inverter",
+				UsageText: "energy-cli pv unlimit --addr <addr>",
+				Flags:     flags,
+				Action: func(c *cli.Context) error {
+					return toExitCode(withPVPlant(c, func(ctx context.Context, p *plant.Plant, addr string) error {
+						err := p.RemovePVLimit(ctx, addr)
+						if err != nil {
+							return err
+						}
+						log.Printf("removed limit of %v", addr)
+						return nil
+					}))
+				},
+			},
+		},
+	}
+}
+
+// withPVPlant connects to the PV inverter of the command and calls f with a plant containing it.
+func withPVPlant(c *cli.Context, f func(ctx context.Context, p *plant.Plant, addr string) error) error {
+	slaveId := c.Uint("slaveId")
+	if slaveId > uint(^byte(0)) {
+		return cli.Exit("slave id must be in range 0 to 254", 1)
+	}
+	addr := c.String("addr")
+
+	plants, err := config.ReadPlantsConfig(c.String("config"))
+	if err != nil {
+		return errors.Wrap(err, "error reading plants config")
+	}
+	if !limitsPV(plants, addr) {
+		return fmt.Errorf("PV inverter %v must not be limited", addr)
+	}
+
+	log.Printf("connecting to %v...", addr)
+	d, err := modbus.DialSunSpec(addr, byte(slaveId), modbusTimeout)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	p, err := plant.NewPlant(nil, plant.Device{Address: addr, SlaveID: byte(slaveId), Reader: d, LimitPower: true})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 4*modbusTimeout)
+	defer cancel()
+	return f(ctx, p, addr)
+}
+
+// limitsPV returns true if the address belongs to a plant allowing PV limits.
+func limitsPV(plants config.Plants, addr string) bool {
+	for _, p := range plants {
+		if !p.LimitsPV() {
+			continue
+		}
+		for _, a := range p.SunSpecAddrs {
+			if a == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -3,14 +3,19 @@ module github.com/orlopau/go-sma-api
 go 1.15
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/goburrow/modbus v0.1.0
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/gosuri/uilive v0.0.4
 	github.com/olekukonko/tablewriter v0.0.4
 	github.com/orlopau/go-energy v0.0.0-20201231125629-d6714b3310bb
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.9.0
 	github.com/spf13/viper v1.7.1
 	github.com/urfave/cli/v2 v2.3.0
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/goleak v1.1.10
 	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9
 )
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"net/http"
+	"time"
+)
+
+// BatteryController writes setpoints to the batteries of a plant.
+type BatteryController interface {
+	SetBattery(ctx context.Context, addr string, sp plant.BatterySetpoint) (time.Time, error)
+	RevertBattery(ctx context.Context, addr string) error
+}
+
+// WithBatteryControl enables the battery setpoint endpoint for the plants.
+func WithBatteryControl(controllers map[string]BatteryController) Option {
+	return func(s *server) {
+		s.batteries = controllers
+	}
+}
+
+type setpointRequest struct {
+	// Address is the address of the battery, it may be omitted if the plant has a single controllable battery.
+	Address string `json:"address,omitempty"`
+	// ChargeLimit and DischargeLimit are in W, null for no limit.
+	ChargeLimit    *float64 `json:"chargeLimit"`
+	DischargeLimit *float64 `json:"dischargeLimit"`
+	// MinReserve is in percent, null to keep the current reserve.
+	MinReserve *float64 `json:"minReserve"`
+	// Timeout is in seconds, 0 for the configured timeout.
+	Timeout float64 `json:"timeout,omitempty"`
+}
+
+type setpointResponse struct {
+	setpointRequest
+	RevertAt int64 `json:"revertAt"`
+}
+
+func (s *server) handleBatterySetpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := s.batteryController(w, r)
+		if !ok {
+			return
+		}
+
+		var req setpointRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeErrorStatus(w, errors.Wrap(err, "error decoding setpoint"), http.StatusBadRequest)
+			return
+		}
+
+		revertAt, err := c.SetBattery(r.Context(), req.Address, plant.BatterySetpoint{
+			ChargeLimit:    req.ChargeLimit,
+			DischargeLimit: req.DischargeLimit,
+			MinReserve:     req.MinReserve,
+			Timeout:        time.Duration(req.Timeout * float64(time.Second)),
+		})
+		if err != nil {
+			writeErrorStatus(w, err, batteryErrorStatus(err))
+			return
+		}
+
+		writeJSON(w, setpointResponse{setpointRequest: req, RevertAt: revertAt.Unix()})
+	}
+}
+
+func (s *server) handleBatteryRevert() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := s.batteryController(w, r)
+		if !ok {
+			return
+		}
+
+		err := c.RevertBattery(r.Context(), r.URL.Query().Get("address"))
+		if err != nil {
+			writeErrorStatus(w, err, batteryErrorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// batteryController returns the controller of the plant of the request, or writes an error if there is none.
+func (s *server) batteryController(w http.ResponseWriter, r *http.Request) (BatteryController, bool) {
+	name := mux.Vars(r)["name"]
+	if _, ok := s.plants[name]; !ok {
+		writeErrorStatus(w, fmt.Errorf("plant %v not found", name), http.StatusNotFound)
+		return nil, false
+	}
+
+	c, ok := s.batteries[name]
+	if !ok {
+		writeErrorStatus(w, fmt.Errorf("plant %v has no controllable battery", name), http.StatusForbidden)
+		return nil, false
+	}
+	return c, true
+}
+
+func batteryErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, plant.ErrInvalidSetpoint):
+		return http.StatusBadRequest
+	case errors.Is(err, plant.ErrDeviceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, plant.ErrNotControllable):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dummyBatteryController struct {
+	err      error
+	revertAt time.Time
+
+	m        sync.Mutex
+	setpoint plant.BatterySetpoint
+	addr     string
+	reverted bool
+}
+
+func (d *dummyBatteryController) SetBattery(ctx context.Context, addr string, sp plant.BatterySetpoint) (time.Time, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.addr, d.setpoint = addr, sp
+	return d.revertAt, d.err
+}
+
+func (d *dummyBatteryController) RevertBattery(ctx context.Context, addr string) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.addr, d.reverted = addr, true
+	return d.err
+}
+
+func TestServer_handleBatterySetpoint(t *testing.T) {
+	t.Parallel()
+
+	revertAt := time.Unix(1608579392, 0)
+	charge, reserve := 1000.0, 20.0
+
+	tests := []struct {
+		name  string
+		plant string
+		body  string
+		// contentType defaults to application/json
+		contentType string
+		controller  *dummyBatteryController
+		exStatus    int
+		exSetpoint  plant.BatterySetpoint
+		exBody      *setpointResponse
+	}{
+		{
+			name:       "Set",
+			plant:      "plant1",
+			body:       `{"address": "battery", "chargeLimit": 1000, "minReserve": 20, "timeout": 600}`,
+			controller: &dummyBatteryController{revertAt: revertAt},
+			exStatus:   http.StatusOK,
+			exSetpoint: plant.BatterySetpoint{ChargeLimit: &charge, MinReserve: &reserve, Timeout: 10 * time.Minute},
+			exBody: &setpointResponse{
+				setpointRequest: setpointRequest{
+					Address:     "battery",
+					ChargeLimit: &charge,
+					MinReserve:  &reserve,
+					Timeout:     600,
+				},
+				RevertAt: revertAt.Unix(),
+			},
+		},
+		{
+			name:        "TextPlain",
+			plant:       "plant1",
+			body:        `{"chargeLimit": 0}`,
+			contentType: "text/plain",
+			controller:  &dummyBatteryController{},
+			exStatus:    http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "JSONWithCharset",
+			plant:       "plant1",
+			body:        `{}`,
+			contentType: "application/json; charset=utf-8",
+			controller:  &dummyBatteryController{},
+			exStatus:    http.StatusOK,
+		},
+		{
+			name:       "InvalidBody",
+			plant:      "plant1",
+			body:       `{"chargeLimit": "full"}`,
+			controller: &dummyBatteryController{},
+			exStatus:   http.StatusBadRequest,
+		},
+		{
+			name:       "InvalidSetpoint",
+			plant:      "plant1",
+			body:       `{"chargeLimit": 100000}`,
+			controller: &dummyBatteryController{err: errors.Wrap(plant.ErrInvalidSetpoint, "too high")},
+			exStatus:   http.StatusBadRequest,
+		},
+		{
+			name:       "UnknownBattery",
+			plant:      "plant1",
+			body:       `{"address": "unknown"}`,
+			controller: &dummyBatteryController{err: plant.ErrDeviceNotFound},
+			exStatus:   http.StatusNotFound,
+		},
+		{
+			name:       "NotControllable",
+			plant:      "plant2",
+			body:       `{}`,
+			controller: &dummyBatteryController{},
+			exStatus:   http.StatusForbidden,
+		},
+		{
+			name:       "UnknownPlant",
+			plant:      "unknown",
+			body:       `{}`,
+			controller: &dummyBatteryController{},
+			exStatus:   http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewServer(
+				map[string]PlantFetcher{"plant1": &dummyPlantFetcher{}, "plant2": &dummyPlantFetcher{}},
+				WithBatteryControl(map[string]BatteryController{"plant1": tt.controller}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/v1/plants/"+tt.plant+"/battery/setpoint",
+				strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			s.ServeHTTP(rec, req)
+
+			if rec.Code != tt.exStatus {
+				t.Fatalf("expected status %v, got %v", tt.exStatus, rec.Code)
+			}
+			if tt.exStatus == http.StatusUnsupportedMediaType && tt.controller.setpoint != (plant.BatterySetpoint{}) {
+				t.Fatalf("expected no setpoint, got %+v", tt.controller.setpoint)
+			}
+
+			if tt.exBody == nil {
+				return
+			}
+
+			if !reflect.DeepEqual(tt.controller.setpoint, tt.exSetpoint) {
+				t.Fatalf("expected setpoint %+v, got %+v", tt.exSetpoint, tt.controller.setpoint)
+			}
+
+			var body setpointResponse
+			err = json.Unmarshal(rec.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body, *tt.exBody) {
+				t.Fatalf("expected %+v, got %+v", *tt.exBody, body)
+			}
+		})
+	}
+}
+
+func TestServer_handleBatteryRevert(t *testing.T) {
+	t.Parallel()
+
+	c := &dummyBatteryController{}
+	s, err := NewServer(
+		map[string]PlantFetcher{"plant1": &dummyPlantFetcher{}},
+		WithBatteryControl(map[string]BatteryController{"plant1": c}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/plants/plant1/battery/setpoint?address=battery", nil))
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %v, got %v", http.StatusNoContent, rec.Code)
+	}
+	if !c.reverted || c.addr != "battery" {
+		t.Fatalf("expected battery to be reverted, got %+v", c)
+	}
+}
+
+func TestServer_routes_cors(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(
+		map[string]PlantFetcher{"plant1": &dummyPlantFetcher{}},
+		WithBatteryControl(map[string]BatteryController{"plant1": &dummyBatteryController{}}),
+		WithPVControl(map[string]PVLimiter{"plant1": &dummyPVLimiter{}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		exAllow bool
+	}{
+		{name: "Summary", method: http.MethodGet, path: "/v1/summary", exAllow: true},
+		{name: "BatterySetpoint", method: http.MethodPost, path: "/v1/plants/plant1/battery/setpoint"},
+		{name: "BatterySetpointPreflight", method: http.MethodOptions, path: "/v1/plants/plant1/battery/setpoint"},
+		{name: "BatteryRevert", method: http.MethodDelete, path: "/v1/plants/plant1/battery/setpoint"},
+		{name: "PVLimit", method: http.MethodPost, path: "/v1/plants/plant1/pv/limit"},
+		{name: "PVLimitPreflight", method: http.MethodOptions, path: "/v1/plants/plant1/pv/limit"},
+		{name: "PVLimitRemove", method: http.MethodDelete, path: "/v1/plants/plant1/pv/limit"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Content-Type", "application/json")
+		if tt.method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+
+		if allow := rec.Header().Get("Access-Control-Allow-Origin") != ""; allow != tt.exAllow {
+			t.Fatalf("%v: expected cross-origin access %v, got headers %v", tt.name, tt.exAllow, rec.Header())
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"net/http"
+)
+
+// DeviceLister lists the configured devices of a plant.
+type DeviceLister interface {
+	Devices() []plant.DeviceInfo
+}
+
+// WithDevices enables the devices endpoint for the plants.
+func WithDevices(devices map[string]DeviceLister) Option {
+	return func(s *server) {
+		s.devices = devices
+	}
+}
+
+type deviceInfoResponse struct {
+	Address string `json:"address"`
+	SlaveID byte   `json:"slaveId"`
+	Type    string `json:"type"`
+	// The identity of the device is omitted while it is pending.
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	SerialNumber string `json:"serialNumber,omitempty"`
+	Version      string `json:"version,omitempty"`
+	Unused       bool   `json:"unused,omitempty"`
+}
+
+func (s *server) handlePlantDevices() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if _, ok := s.plants[name]; !ok {
+			writeErrorStatus(w, fmt.Errorf("plant %v not found", name), http.StatusNotFound)
+			return
+		}
+
+		res := []deviceInfoResponse{}
+		if l, ok := s.devices[name]; ok {
+			for _, d := range l.Devices() {
+				res = append(res, deviceInfoResponse{
+					Address:      d.Address,
+					SlaveID:      d.SlaveID,
+					Type:         d.Type,
+					Manufacturer: d.Identity.Manufacturer,
+					Model:        d.Identity.Model,
+					SerialNumber: d.Identity.SerialNumber,
+					Version:      d.Identity.Version,
+					Unused:       d.Unused,
+				})
+			}
+		}
+
+		writeJSON(w, res)
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type dummyDeviceLister []plant.DeviceInfo
+
+func (d dummyDeviceLister) Devices() []plant.DeviceInfo {
+	return d
+}
+
+func TestServer_handlePlantDevices(t *testing.T) {
+	t.Parallel()
+
+	plants := map[string]PlantFetcher{"plant1": &dummyPlantFetcher{}, "plant2": &dummyPlantFetcher{}}
+	devices := map[string]DeviceLister{
+		"plant1": dummyDeviceLister{
+			{
+				Address: "192.168.188.30:502",
+				SlaveID: 126,
+				Type:    plant.DeviceTypePV,
+				Identity: plant.Identity{
+					Manufacturer: "SMA",
+					Model:        "SB3.0-1AV-41",
+					Version:      "3.10.18.R",
+					SerialNumber: "3005067415",
+				},
+			},
+			{Address: "192.168.188.34:502", SlaveID: 126, Type: plant.DeviceTypeUnknown},
+		},
+	}
+
+	s, err := NewServer(plants, WithDevices(devices))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		exStatus int
+		exBody   []deviceInfoResponse
+	}{
+		{
+			name:     "Devices",
+			path:     "/v1/plants/plant1/devices",
+			exStatus: http.StatusOK,
+			exBody: []deviceInfoResponse{
+				{
+					Address:      "192.168.188.30:502",
+					SlaveID:      126,
+					Type:         plant.DeviceTypePV,
+					Manufacturer: "SMA",
+					Model:        "SB3.0-1AV-41",
+					SerialNumber: "3005067415",
+					Version:      "3.10.18.R",
+				},
+				{Address: "192.168.188.34:502", SlaveID: 126, Type: plant.DeviceTypeUnknown},
+			},
+		},
+		{
+			name:     "NoDevices",
+			path:     "/v1/plants/plant2/devices",
+			exStatus: http.StatusOK,
+			exBody:   []deviceInfoResponse{},
+		},
+		{
+			name:     "Unknown",
+			path:     "/v1/plants/unknown/devices",
+			exStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.exStatus {
+				t.Fatalf("expected status %v, got %v", tt.exStatus, rec.Code)
+			}
+
+			if tt.exBody == nil {
+				return
+			}
+
+			var body []deviceInfoResponse
+			err := json.Unmarshal(rec.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(body, tt.exBody) {
+				t.Fatalf("expected %+v, got %+v", tt.exBody, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/orlopau/go-sma-api/internal/energy"
+	"net/http"
+	"time"
+)
+
+type energyPeriodResponse struct {
+	Start int64 `json:"start"`
+	energy.Totals
+}
+
+type energyResponse struct {
+	Today energyPeriodResponse `json:"today"`
+	Month energyPeriodResponse `json:"month"`
+	Year  energyPeriodResponse `json:"year"`
+}
+
+func newEnergyPeriodResponse(p energy.Period) energyPeriodResponse {
+	return energyPeriodResponse{
+		Start:  p.Start.Unix(),
+		Totals: p.Totals,
+	}
+}
+
+func (s *server) handlePlantEnergy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if _, ok := s.plants[name]; !ok {
+			writeErrorStatus(w, fmt.Errorf("plant %v not found", name), http.StatusNotFound)
+			return
+		}
+
+		periods := s.energy.Totals(name, time.Now())
+
+		writeJSON(w, energyResponse{
+			Today: newEnergyPeriodResponse(periods.Day),
+			Month: newEnergyPeriodResponse(periods.Month),
+			Year:  newEnergyPeriodResponse(periods.Year),
+		})
+	}
+}
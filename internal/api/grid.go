@@ -0,0 +1,100 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+type phaseResponse struct {
+	Phase       string  `json:"phase"`
+	Power       float32 `json:"power"`
+	Voltage     float32 `json:"voltage"`
+	Current     float32 `json:"current"`
+	PowerFactor float32 `json:"powerFactor"`
+}
+
+type gridResponse struct {
+	Power        float32         `json:"power"`
+	ImportEnergy float64         `json:"importEnergy,omitempty"`
+	ExportEnergy float64         `json:"exportEnergy,omitempty"`
+	Phases       []phaseResponse `json:"phases"`
+	// Imbalance is the difference between the highest and the lowest power of all phases.
+	Imbalance *float32 `json:"imbalance"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+func newPhaseResponses(phases []plant.Phase) []phaseResponse {
+	if phases == nil {
+		return nil
+	}
+
+	res := make([]phaseResponse, len(phases))
+	for i, p := range phases {
+		res[i] = phaseResponse{
+			Phase:       fmt.Sprintf("L%d", i+1),
+			Power:       p.Power,
+			Voltage:     p.Voltage,
+			Current:     p.Current,
+			PowerFactor: p.PowerFactor,
+		}
+	}
+	return res
+}
+
+func phaseImbalance(phases []plant.Phase) *float32 {
+	if len(phases) == 0 {
+		return nil
+	}
+
+	min, max := phases[0].Power, phases[0].Power
+	for _, p := range phases[1:] {
+		if p.Power < min {
+			min = p.Power
+		}
+		if p.Power > max {
+			max = p.Power
+		}
+	}
+
+	imbalance := max - min
+	return &imbalance
+}
+
+func (s *server) handlePlantGrid() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		p, ok := s.plants[name]
+		if !ok {
+			writeErrorStatus(w, fmt.Errorf("plant %v not found", name), http.StatusNotFound)
+			return
+		}
+
+		summary, err := p.FetchSummary()
+		if err != nil {
+			writeError(w, errors.Wrap(err, "error fetching data from plant"))
+			return
+		}
+
+		if !summary.HasGrid {
+			writeErrorStatus(w, fmt.Errorf("plant %v has no grid meter", name), http.StatusNotFound)
+			return
+		}
+
+		phases := newPhaseResponses(summary.GridPhases)
+		if phases == nil {
+			phases = []phaseResponse{}
+		}
+
+		writeJSON(w, gridResponse{
+			Power:        summary.Grid,
+			ImportEnergy: summary.GridImportEnergy,
+			ExportEnergy: summary.GridExportEnergy,
+			Phases:       phases,
+			Imbalance:    phaseImbalance(summary.GridPhases),
+			Timestamp:    summary.TimestampEnd.Unix(),
+		})
+	}
+}
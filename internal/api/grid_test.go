@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer_handlePlantGrid(t *testing.T) {
+	t.Parallel()
+
+	s := newDummyServer(t, map[string]PlantFetcher{
+		"phases": &dummyPlantFetcher{summary: plant.Summary{
+			Grid:    200,
+			HasGrid: true,
+			GridPhases: []plant.Phase{
+				{Power: 100, Voltage: 230, Current: 0.5, PowerFactor: 1},
+				{Power: 150},
+				{Power: -50},
+			},
+		}},
+		"total":   &dummyPlantFetcher{summary: plant.Summary{Grid: 200, HasGrid: true}},
+		"nometer": &dummyPlantFetcher{summary: plant.Summary{PV: 200}},
+	})
+
+	tests := []struct {
+		name        string
+		plant       string
+		exStatus    int
+		exPhases    int
+		exImbalance *float32
+	}{
+		{name: "Phases", plant: "phases", exStatus: http.StatusOK, exPhases: 3,
+			exImbalance: func() *float32 { v := float32(200); return &v }()},
+		{name: "TotalOnly", plant: "total", exStatus: http.StatusOK},
+		{name: "NoMeter", plant: "nometer", exStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/plants/"+tt.plant+"/grid", nil))
+			if rec.Code != tt.exStatus {
+				t.Fatalf("expected status %v, got %v", tt.exStatus, rec.Code)
+			}
+			if tt.exStatus != http.StatusOK {
+				return
+			}
+
+			var res gridResponse
+			err := json.Unmarshal(rec.Body.Bytes(), &res)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Power != 200 || len(res.Phases) != tt.exPhases {
+				t.Fatalf("unexpected response %+v", res)
+			}
+			if (res.Imbalance == nil) != (tt.exImbalance == nil) ||
+				res.Imbalance != nil && *res.Imbalance != *tt.exImbalance {
+				t.Fatalf("expected imbalance %v, got %v", tt.exImbalance, res.Imbalance)
+			}
+			if tt.exPhases > 0 && res.Phases[0] != (phaseResponse{"L1", 100, 230, 0.5, 1}) {
+				t.Fatalf("unexpected first phase %+v", res.Phases[0])
+			}
+		})
+	}
+}
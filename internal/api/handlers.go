@@ -2,53 +2,219 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/orlopau/go-sma-api/internal/plant"
 	"github.com/pkg/errors"
 	"log"
 	"net/http"
 )
 
-func (s *server) handlePlantSummary() http.HandlerFunc {
-	type plant struct {
-		Grid            float32 `json:"grid"`
-		PV              float32 `json:"pv"`
-		Bat             float32 `json:"battery"`
-		SelfConsumption float32 `json:"selfConsumption"`
-		BatSoC          uint    `json:"batterySoC"`
-		TimestampStart  int64   `json:"timestampStart"`
-		TimestampEnd    int64   `json:"timestampEnd"`
+type summaryResponse struct {
+	// Grid and SelfConsumption are null if the plant has no grid meter.
+	Grid *float32 `json:"grid"`
+	PV   float32  `json:"pv"`
+	// Bat and BatSoC are null if the plant has no battery.
+	Bat             *float32 `json:"battery"`
+	SelfConsumption *float32 `json:"selfConsumption"`
+	BatSoC          *uint    `json:"batterySoC"`
+	TimestampStart  int64    `json:"timestampStart"`
+	TimestampEnd    int64    `json:"timestampEnd"`
+	// Age is the age of the summary in milliseconds, Stale is true if it exceeds the staleness threshold.
+	Age   int64 `json:"age"`
+	Stale bool  `json:"stale"`
+	// GridImportEnergy and GridExportEnergy are omitted if the meter doesn't provide them.
+	GridImportEnergy float64 `json:"gridImportEnergy,omitempty"`
+	GridExportEnergy float64 `json:"gridExportEnergy,omitempty"`
+	// GridPhases is omitted if the meter doesn't measure each phase.
+	GridPhases []phaseResponse  `json:"gridPhases,omitempty"`
+	Devices    []deviceResponse `json:"devices"`
+}
+
+type deviceResponse struct {
+	Address string  `json:"address"`
+	Type    string  `json:"type"`
+	Power   float32 `json:"power"`
+	// SoC is only set for battery inverters.
+	SoC *uint `json:"soc,omitempty"`
+	// Capacity is the configured capacity of battery inverters in Wh.
+	Capacity float64 `json:"capacity,omitempty"`
+	LastRead *int64  `json:"lastRead"`
+	Error    string  `json:"error,omitempty"`
+	// Connection is omitted if the device isn't supervised.
+	Connection *connectionResponse `json:"connection,omitempty"`
+	Unused     bool                `json:"unused,omitempty"`
+}
+
+type connectionResponse struct {
+	State string `json:"state"`
+	Since int64  `json:"since"`
+	// Error is the error which broke the connection, or the error of the last reconnect attempt.
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+func newConnectionResponse(c plant.ConnState) *connectionResponse {
+	if c.State == "" {
+		return nil
+	}
+
+	res := &connectionResponse{
+		State:    c.State,
+		Since:    c.Since.Unix(),
+		Attempts: c.Attempts,
+	}
+	if c.Err != nil {
+		res.Error = c.Err.Error()
+	}
+	return res
+}
+
+func newDeviceResponses(devices []plant.DeviceSummary) []deviceResponse {
+	res := make([]deviceResponse, len(devices))
+	for i, d := range devices {
+		res[i] = deviceResponse{
+			Address:    d.Address,
+			Type:       d.Type,
+			Power:      d.Power,
+			Capacity:   d.Capacity,
+			Connection: newConnectionResponse(d.Connection),
+			Unused:     d.Unused,
+		}
+
+		if d.Type == plant.DeviceTypeBattery {
+			soc := d.SoC
+			res[i].SoC = &soc
+		}
+		if !d.LastRead.IsZero() {
+			lastRead := d.LastRead.Unix()
+			res[i].LastRead = &lastRead
+		}
+		if d.Err != nil {
+			res[i].Error = d.Err.Error()
+		}
+	}
+	return res
+}
+
+func newSummaryResponse(summary plant.Summary) summaryResponse {
+	res := summaryResponse{
+		PV:               summary.PV,
+		TimestampStart:   summary.TimestampStart.Unix(),
+		TimestampEnd:     summary.TimestampEnd.Unix(),
+		Age:              summary.Age.Milliseconds(),
+		Stale:            summary.Stale,
+		GridImportEnergy: summary.GridImportEnergy,
+		GridExportEnergy: summary.GridExportEnergy,
+		GridPhases:       newPhaseResponses(summary.GridPhases),
+		Devices:          newDeviceResponses(summary.Devices),
+	}
+
+	if summary.HasGrid {
+		grid, selfConsumption := summary.Grid, summary.SelfConsumption
+		res.Grid = &grid
+		res.SelfConsumption = &selfConsumption
+	}
+
+	if summary.HasBattery {
+		bat, soc := summary.Bat, summary.BatPercentage
+		res.Bat = &bat
+		res.BatSoC = &soc
+	}
+
+	return res
+}
+
+type errorResponse struct {
+	Message string `json:"message"`
+	Class   string `json:"class"`
+	Since   *int64 `json:"since,omitempty"`
+}
+
+func newErrorResponse(err error) *errorResponse {
+	res := &errorResponse{
+		Message: err.Error(),
+		Class:   plant.ErrorClass(err),
 	}
 
+	var fetchErr *plant.FetchError
+	if errors.As(err, &fetchErr) {
+		since := fetchErr.Since.Unix()
+		res.Since = &since
+	}
+
+	return res
+}
+
+// plantResponse contains either the summary of a plant or the error preventing it from being fetched.
+type plantResponse struct {
+	*summaryResponse
+	Error *errorResponse `json:"error,omitempty"`
+}
+
+func (s *server) handleSummary() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		plants := make(map[string]plant, len(s.plants))
+		plants := make(map[string]plantResponse, len(s.plants))
+		var failed int
 
 		for k, v := range s.plants {
 			summary, err := v.FetchSummary()
 			if err != nil {
-				writeError(w, errors.Wrap(err, "error fetching data from plant"))
-				return
+				log.Println(errors.Wrap(err, fmt.Sprintf("error fetching data from plant %v", k)))
+				plants[k] = plantResponse{Error: newErrorResponse(err)}
+				failed++
+				continue
 			}
 
-			plants[k] = plant{
-				Grid:            summary.Grid,
-				PV:              summary.PV,
-				Bat:             summary.Bat,
-				SelfConsumption: summary.SelfConsumption,
-				BatSoC:          summary.BatPercentage,
-				TimestampStart:  summary.TimestampStart.Unix(),
-				TimestampEnd:    summary.TimestampEnd.Unix(),
-			}
+			res := newSummaryResponse(summary)
+			plants[k] = plantResponse{summaryResponse: &res}
+		}
+
+		status := http.StatusOK
+		if failed > 0 {
+			status = http.StatusMultiStatus
+		}
+		if failed > 0 && failed == len(s.plants) {
+			status = http.StatusServiceUnavailable
 		}
 
-		writeJSON(w, plants)
+		writeJSONStatus(w, plants, status)
+	}
+}
+
+func (s *server) handlePlantSummary() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		p, ok := s.plants[name]
+		if !ok {
+			writeErrorStatus(w, fmt.Errorf("plant %v not found", name), http.StatusNotFound)
+			return
+		}
+
+		summary, err := p.FetchSummary()
+		if err != nil {
+			writeError(w, errors.Wrap(err, "error fetching data from plant"))
+			return
+		}
+
+		writeJSON(w, newSummaryResponse(summary))
 	}
 }
 
 func writeError(w http.ResponseWriter, err error) {
+	writeErrorStatus(w, err, http.StatusInternalServerError)
+}
+
+func writeErrorStatus(w http.ResponseWriter, err error, status int) {
 	log.Println(err)
-	http.Error(w, err.Error(), http.StatusInternalServerError)
+	http.Error(w, err.Error(), status)
 }
 
 func writeJSON(w http.ResponseWriter, data interface{}) {
+	writeJSONStatus(w, data, http.StatusOK)
+}
+
+func writeJSONStatus(w http.ResponseWriter, data interface{}, status int) {
 	jsn, err := json.Marshal(data)
 	if err != nil {
 		wrappedErr := errors.Wrap(err, "error encoding json")
@@ -58,6 +224,7 @@ func writeJSON(w http.ResponseWriter, data interface{}) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	_, err = w.Write(jsn)
 	if err != nil {
 		log.Println(err)
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dummyPlantFetcher struct {
+	summary plant.Summary
+	err     error
+
+	m    sync.Mutex
+	subs map[chan plant.Summary]struct{}
+}
+
+func (d *dummyPlantFetcher) FetchSummary() (plant.Summary, error) {
+	return d.summary, d.err
+}
+
+func (d *dummyPlantFetcher) Subscribe() (<-chan plant.Summary, func()) {
+	c := make(chan plant.Summary, 1)
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.subs == nil {
+		d.subs = make(map[chan plant.Summary]struct{})
+	}
+	d.subs[c] = struct{}{}
+
+	return c, func() {
+		d.m.Lock()
+		defer d.m.Unlock()
+		delete(d.subs, c)
+	}
+}
+
+func (d *dummyPlantFetcher) publish(s plant.Summary) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	for c := range d.subs {
+		c <- s
+	}
+}
+
+func (d *dummyPlantFetcher) subscribers() int {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return len(d.subs)
+}
+
+// waitFor polls the condition until it is true or fails the test after a second.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newDummyServer(t *testing.T, plants map[string]PlantFetcher) *server {
+	t.Helper()
+
+	s, err := NewServer(plants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestServer_handlePlantSummary(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1608579392, 0)
+	s := newDummyServer(t, map[string]PlantFetcher{
+		"healthy": &dummyPlantFetcher{
+			summary: plant.Summary{
+				Grid:            -50,
+				PV:              300,
+				SelfConsumption: 250,
+				HasGrid:         true,
+				TimestampStart:  now,
+				TimestampEnd:    now,
+			},
+		},
+		"battery": &dummyPlantFetcher{
+			summary: plant.Summary{
+				Grid:            -50,
+				Bat:             100,
+				SelfConsumption: 50,
+				BatPercentage:   0,
+				HasBattery:      true,
+				HasGrid:         true,
+				TimestampStart:  now,
+				TimestampEnd:    now,
+			},
+		},
+		"stale": &dummyPlantFetcher{
+			summary: plant.Summary{
+				PV:             300,
+				TimestampStart: now,
+				TimestampEnd:   now,
+				Age:            15 * time.Second,
+				Stale:          true,
+			},
+		},
+		"offline": &dummyPlantFetcher{err: fmt.Errorf("dummy error")},
+	})
+
+	bat, soc := float32(100), uint(0)
+	grid, selfConsumption, batSelfConsumption := float32(-50), float32(250), float32(50)
+
+	tests := []struct {
+		name     string
+		path     string
+		exStatus int
+		exBody   *summaryResponse
+	}{
+		{
+			name:     "Healthy",
+			path:     "/v1/plants/healthy/summary",
+			exStatus: http.StatusOK,
+			exBody: &summaryResponse{
+				Grid:            &grid,
+				PV:              300,
+				SelfConsumption: &selfConsumption,
+				TimestampStart:  now.Unix(),
+				TimestampEnd:    now.Unix(),
+				Devices:         []deviceResponse{},
+			},
+		},
+		{
+			name:     "Battery",
+			path:     "/v1/plants/battery/summary",
+			exStatus: http.StatusOK,
+			exBody: &summaryResponse{
+				Grid:            &grid,
+				Bat:             &bat,
+				SelfConsumption: &batSelfConsumption,
+				BatSoC:          &soc,
+				TimestampStart:  now.Unix(),
+				TimestampEnd:    now.Unix(),
+				Devices:         []deviceResponse{},
+			},
+		},
+		{
+			name:     "Stale",
+			path:     "/v1/plants/stale/summary",
+			exStatus: http.StatusOK,
+			exBody: &summaryResponse{
+				PV:             300,
+				TimestampStart: now.Unix(),
+				TimestampEnd:   now.Unix(),
+				Age:            15000,
+				Stale:          true,
+				Devices:        []deviceResponse{},
+			},
+		},
+		{
+			name:     "Offline",
+			path:     "/v1/plants/offline/summary",
+			exStatus: http.StatusInternalServerError,
+		},
+		{
+			name:     "Unknown",
+			path:     "/v1/plants/unknown/summary",
+			exStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.exStatus {
+				t.Fatalf("expected status %v, got %v", tt.exStatus, rec.Code)
+			}
+
+			if tt.exBody == nil {
+				return
+			}
+
+			var body summaryResponse
+			err := json.Unmarshal(rec.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(body, *tt.exBody) {
+				t.Fatalf("expected %v, got %v", *tt.exBody, body)
+			}
+		})
+	}
+}
+
+func TestServer_handleSummary(t *testing.T) {
+	t.Parallel()
+
+	since := time.Unix(1608579000, 0)
+	healthy := &dummyPlantFetcher{summary: plant.Summary{PV: 300}}
+	offline := &dummyPlantFetcher{err: &plant.FetchError{Err: plant.ErrNoData, Since: since}}
+
+	tests := []struct {
+		name     string
+		plants   map[string]PlantFetcher
+		exStatus int
+	}{
+		{
+			name:     "AllHealthy",
+			plants:   map[string]PlantFetcher{"p1": healthy, "p2": healthy},
+			exStatus: http.StatusOK,
+		},
+		{
+			name:     "PartiallyDegraded",
+			plants:   map[string]PlantFetcher{"p1": healthy, "p2": offline},
+			exStatus: http.StatusMultiStatus,
+		},
+		{
+			name:     "AllOffline",
+			plants:   map[string]PlantFetcher{"p1": offline, "p2": offline},
+			exStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newDummyServer(t, tt.plants)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/summary", nil))
+
+			if rec.Code != tt.exStatus {
+				t.Fatalf("expected status %v, got %v", tt.exStatus, rec.Code)
+			}
+
+			var body map[string]struct {
+				PV    *float32       `json:"pv"`
+				Error *errorResponse `json:"error"`
+			}
+			err := json.Unmarshal(rec.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(body) != len(tt.plants) {
+				t.Fatalf("expected %v plants, got %v", len(tt.plants), len(body))
+			}
+
+			for k, v := range tt.plants {
+				res := body[k]
+				if v == healthy && (res.Error != nil || res.PV == nil || *res.PV != 300) {
+					t.Fatalf("expected summary for plant %v, got %+v", k, res)
+				}
+				if v == offline {
+					if res.PV != nil || res.Error == nil {
+						t.Fatalf("expected error for plant %v, got %+v", k, res)
+					}
+					if res.Error.Class != plant.ErrorClassNoData || res.Error.Since == nil || *res.Error.Since != since.Unix() {
+						t.Fatalf("unexpected error for plant %v: %+v", k, *res.Error)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"net/http"
+	"time"
+)
+
+// defaultReadyMaxAge is the maximum age of the summary of a ready plant, if not configured otherwise.
+const defaultReadyMaxAge = 30 * time.Second
+
+// Statuses of a healthResponse.
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// WithReadyMaxAge sets the maximum age of the summary of each plant for the server to be ready.
+func WithReadyMaxAge(d time.Duration) Option {
+	return func(s *server) {
+		s.readyMaxAge = d
+	}
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+	// Plants is only set for readiness checks.
+	Plants map[string]plantReadiness `json:"plants,omitempty"`
+}
+
+type plantReadiness struct {
+	Ready bool `json:"ready"`
+	// Reason is the reason why the plant isn't ready.
+	Reason string `json:"reason,omitempty"`
+	// Age is the age of the last summary in milliseconds, null if the plant has no summary.
+	Age *int64 `json:"age"`
+	// Devices contains the devices which aren't ready.
+	Devices []deviceReadiness `json:"devices,omitempty"`
+}
+
+type deviceReadiness struct {
+	Address string `json:"address"`
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+}
+
+// handleHealth responds as long as the server is running.
+func (s *server) handleHealth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, healthResponse{Status: statusOK})
+	}
+}
+
+// handleReady responds with 200 if every plant has a recent summary and all of its devices are connected, with 503
+// otherwise.
+func (s *server) handleReady() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := healthResponse{Status: statusOK, Plants: make(map[string]plantReadiness, len(s.plants))}
+
+		for k, v := range s.plants {
+			pr := s.plantReadiness(v)
+			if !pr.Ready {
+				res.Status = statusUnavailable
+			}
+			res.Plants[k] = pr
+		}
+
+		status := http.StatusOK
+		if res.Status != statusOK {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSONStatus(w, res, status)
+	}
+}
+
+func (s *server) plantReadiness(p PlantFetcher) plantReadiness {
+	summary, err := p.FetchSummary()
+	if err != nil {
+		return plantReadiness{Reason: err.Error()}
+	}
+
+	age := summary.Age.Milliseconds()
+	res := plantReadiness{Ready: true, Age: &age}
+
+	for _, d := range summary.Devices {
+		if d.Unused {
+			continue
+		}
+		reason := deviceNotReadyReason(d)
+		if reason == "" {
+			continue
+		}
+		res.Devices = append(res.Devices, deviceReadiness{Address: d.Address, Type: d.Type, Reason: reason})
+	}
+
+	switch {
+	case summary.Age > s.readyMaxAge:
+		res.Ready = false
+		res.Reason = fmt.Sprintf("last summary is older than %v", s.readyMaxAge)
+	case len(res.Devices) > 0:
+		res.Ready = false
+		res.Reason = fmt.Sprintf("%v of %v devices not ready", len(res.Devices), len(summary.Devices))
+	}
+
+	return res
+}
+
+// deviceNotReadyReason returns why the device isn't ready, empty if it is ready.
+func deviceNotReadyReason(d plant.DeviceSummary) string {
+	if state := d.Connection.State; state != "" && state != plant.ConnStateConnected {
+		if d.Connection.Err != nil {
+			return fmt.Sprintf("%v: %v", state, d.Connection.Err)
+		}
+		return state
+	}
+
+	if d.Err != nil {
+		return d.Err.Error()
+	}
+
+	return ""
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServer_handleHealth(t *testing.T) {
+	t.Parallel()
+
+	s := newDummyServer(t, map[string]PlantFetcher{"offline": &dummyPlantFetcher{err: fmt.Errorf("dummy error")}})
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, rec.Code)
+	}
+}
+
+func TestServer_handleReady(t *testing.T) {
+	t.Parallel()
+
+	connected := plant.DeviceSummary{
+		Address:    "inverter",
+		Type:       plant.DeviceTypePV,
+		Connection: plant.ConnState{State: plant.ConnStateConnected},
+	}
+	pending := plant.DeviceSummary{
+		Address: "battery",
+		Type:    plant.DeviceTypeUnknown,
+		Connection: plant.ConnState{
+			State: plant.ConnStatePending,
+			Err:   fmt.Errorf("connection refused"),
+		},
+	}
+
+	healthy := &dummyPlantFetcher{summary: plant.Summary{Age: time.Second, Devices: []plant.DeviceSummary{connected}}}
+	old := &dummyPlantFetcher{summary: plant.Summary{Age: time.Minute}}
+	partial := &dummyPlantFetcher{summary: plant.Summary{Devices: []plant.DeviceSummary{connected, pending}}}
+	offline := &dummyPlantFetcher{err: fmt.Errorf("dummy error")}
+
+	second, minute, zero := int64(1000), int64(60000), int64(0)
+
+	tests := []struct {
+		name     string
+		plants   map[string]PlantFetcher
+		exStatus int
+		exBody   healthResponse
+	}{
+		{
+			name:     "Ready",
+			plants:   map[string]PlantFetcher{"healthy": healthy},
+			exStatus: http.StatusOK,
+			exBody: healthResponse{
+				Status: statusOK,
+				Plants: map[string]plantReadiness{"healthy": {Ready: true, Age: &second}},
+			},
+		},
+		{
+			name:     "Old",
+			plants:   map[string]PlantFetcher{"healthy": healthy, "old": old},
+			exStatus: http.StatusServiceUnavailable,
+			exBody: healthResponse{
+				Status: statusUnavailable,
+				Plants: map[string]plantReadiness{
+					"healthy": {Ready: true, Age: &second},
+					"old":     {Reason: "last summary is older than 30s", Age: &minute},
+				},
+			},
+		},
+		{
+			name:     "PendingDevice",
+			plants:   map[string]PlantFetcher{"partial": partial},
+			exStatus: http.StatusServiceUnavailable,
+			exBody: healthResponse{
+				Status: statusUnavailable,
+				Plants: map[string]plantReadiness{
+					"partial": {
+						Reason: "1 of 2 devices not ready",
+						Age:    &zero,
+						Devices: []deviceReadiness{
+							{Address: "battery", Type: plant.DeviceTypeUnknown, Reason: "pending: connection refused"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:     "Offline",
+			plants:   map[string]PlantFetcher{"offline": offline},
+			exStatus: http.StatusServiceUnavailable,
+			exBody: healthResponse{
+				Status: statusUnavailable,
+				Plants: map[string]plantReadiness{"offline": {Reason: "dummy error"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newDummyServer(t, tt.plants)
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rec.Code != tt.exStatus {
+				t.Fatalf("expected status %v, got %v", tt.exStatus, rec.Code)
+			}
+
+			var body healthResponse
+			err := json.Unmarshal(rec.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(body, tt.exBody) {
+				t.Fatalf("expected %+v, got %+v", tt.exBody, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultHistoryRange is the queried time range if no from time is given.
+	defaultHistoryRange = time.Hour
+	// maxHistoryPoints limits the number of points returned by a single query.
+	maxHistoryPoints = 10000
+)
+
+type historyPoint struct {
+	Timestamp int64 `json:"timestamp"`
+	// Grid and SelfConsumption are omitted if the plant had no grid meter.
+	Grid *float32 `json:"grid,omitempty"`
+	PV   float32  `json:"pv"`
+	// Bat and BatSoC are omitted if the plant had no battery.
+	Bat             *float32 `json:"battery,omitempty"`
+	SelfConsumption *float32 `json:"selfConsumption,omitempty"`
+	BatSoC          *float32 `json:"batterySoC,omitempty"`
+}
+
+type historyResponse struct {
+	From   int64          `json:"from"`
+	To     int64          `json:"to"`
+	Step   float64        `json:"step"`
+	Points []historyPoint `json:"points"`
+}
+
+func (s *server) handlePlantHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if _, ok := s.plants[name]; !ok {
+			writeErrorStatus(w, fmt.Errorf("plant %v not found", name), http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+
+		to := time.Now()
+		if v := q.Get("to"); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeErrorStatus(w, errors.Wrap(err, "invalid to"), http.StatusBadRequest)
+				return
+			}
+			to = time.Unix(ts, 0)
+		}
+
+		from := to.Add(-defaultHistoryRange)
+		if v := q.Get("from"); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeErrorStatus(w, errors.Wrap(err, "invalid from"), http.StatusBadRequest)
+				return
+			}
+			from = time.Unix(ts, 0)
+		}
+
+		if !from.Before(to) {
+			writeErrorStatus(w, fmt.Errorf("from must be before to"), http.StatusBadRequest)
+			return
+		}
+
+		var step time.Duration
+		if v := q.Get("step"); v != "" {
+			var err error
+			step, err = time.ParseDuration(v)
+			if err != nil {
+				writeErrorStatus(w, errors.Wrap(err, "invalid step"), http.StatusBadRequest)
+				return
+			}
+			if step < 0 {
+				writeErrorStatus(w, fmt.Errorf("step must not be negative"), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// increase the step if the query would return too many points
+		if minStep := to.Sub(from) / maxHistoryPoints; step < minStep {
+			step = minStep.Truncate(time.Second) + time.Second
+		}
+
+		points, step, err := s.history.Query(name, from, to, step)
+		if err != nil {
+			writeError(w, errors.Wrap(err, "error querying history"))
+			return
+		}
+
+		res := historyResponse{
+			From:   from.Unix(),
+			To:     to.Unix(),
+			Step:   step.Seconds(),
+			Points: make([]historyPoint, len(points)),
+		}
+		for i, p := range points {
+			hp := historyPoint{
+				Timestamp: p.Time.Unix(),
+				PV:        p.PV,
+			}
+			if p.HasGrid {
+				grid, selfConsumption := p.Grid, p.SelfConsumption
+				hp.Grid, hp.SelfConsumption = &grid, &selfConsumption
+			}
+			if p.HasBattery {
+				bat, soc := p.Bat, p.BatPercentage
+				hp.Bat, hp.BatSoC = &bat, &soc
+			}
+			res.Points[i] = hp
+		}
+
+		writeJSON(w, res)
+	}
+}
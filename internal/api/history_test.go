@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/orlopau/go-sma-api/internal/history"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type dummyHistory struct {
+	from, to time.Time
+	step     time.Duration
+	// resolution is the step of the returned points, the queried step if 0.
+	resolution time.Duration
+}
+
+func (d *dummyHistory) Query(name string, from, to time.Time, step time.Duration) ([]history.Point, time.Duration, error) {
+	d.from, d.to, d.step = from, to, step
+	if d.resolution != 0 {
+		step = d.resolution
+	}
+	return []history.Point{
+		{Time: from, PV: 100},
+		{Time: to, PV: 100, Grid: 10, SelfConsumption: 60, HasGrid: true, Bat: -50, BatPercentage: 45, HasBattery: true},
+	}, step, nil
+}
+
+func TestServer_handlePlantHistory(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		query      string
+		resolution time.Duration
+		exStatus   int
+		exStep     time.Duration
+		exResStep  time.Duration
+	}{
+		{
+			name: "Valid", query: "?from=1608500000&to=1608579392&step=15m",
+			exStatus: http.StatusOK, exStep: 15 * time.Minute, exResStep: 15 * time.Minute,
+		},
+		{
+			name: "TooManyPoints", query: "?from=1608500000&to=1608579392&step=1s",
+			exStatus: http.StatusOK, exStep: 8 * time.Second, exResStep: 8 * time.Second,
+		},
+		{
+			name: "CoarserResolution", query: "?from=1608500000&to=1608579392&step=15m", resolution: time.Hour,
+			exStatus: http.StatusOK, exStep: 15 * time.Minute, exResStep: time.Hour,
+		},
+		{name: "InvalidRange", query: "?from=1608579392&to=1608500000", exStatus: http.StatusBadRequest},
+		{name: "InvalidStep", query: "?step=abc", exStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := &dummyHistory{resolution: tt.resolution}
+			s, err := NewServer(map[string]PlantFetcher{"p1": &dummyPlantFetcher{}}, WithHistory(h))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/plants/p1/history"+tt.query, nil))
+			if rec.Code != tt.exStatus {
+				t.Fatalf("expected status %v, got %v", tt.exStatus, rec.Code)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			var res historyResponse
+			err = json.Unmarshal(rec.Body.Bytes(), &res)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h.step != tt.exStep {
+				t.Fatalf("expected queried step %v, got %v", tt.exStep, h.step)
+			}
+			if res.Step != tt.exResStep.Seconds() {
+				t.Fatalf("expected step %v in response, got %vs", tt.exResStep, res.Step)
+			}
+			if len(res.Points) != 2 || res.Points[0].Timestamp != h.from.Unix() || res.Points[0].PV != 100 {
+				t.Fatalf("unexpected points %v", res.Points)
+			}
+			if p := res.Points[0]; p.Grid != nil || p.SelfConsumption != nil || p.Bat != nil || p.BatSoC != nil {
+				t.Fatalf("expected no grid and battery values, got %+v", p)
+			}
+			if p := res.Points[1]; p.Grid == nil || *p.Grid != 10 || p.SelfConsumption == nil || *p.SelfConsumption != 60 {
+				t.Fatalf("expected grid values, got %+v", p)
+			}
+			if p := res.Points[1]; p.Bat == nil || *p.Bat != -50 || p.BatSoC == nil || *p.BatSoC != 45 {
+				t.Fatalf("expected battery values, got %+v", p)
+			}
+		})
+	}
+}
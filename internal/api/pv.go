@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"net/http"
+	"time"
+)
+
+// PVLimiter limits the active power of the PV inverters of a plant.
+type PVLimiter interface {
+	LimitPV(ctx context.Context, addr string, pct float64, timeout time.Duration) error
+	RemovePVLimit(ctx context.Context, addr string) error
+}
+
+// WithPVControl enables the PV limit endpoint for the plants.
+func WithPVControl(limiters map[string]PVLimiter) Option {
+	return func(s *server) {
+		s.pv = limiters
+	}
+}
+
+type pvLimitRequest struct {
+	// Address is the address of the PV inverter, all limitable PV inverters are limited if omitted.
+	Address string `json:"address,omitempty"`
+	// Limit is in percent of the rated power.
+	Limit float64 `json:"limit"`
+	// Timeout is in seconds, 0 to keep the limit until it is removed.
+	Timeout float64 `json:"timeout,omitempty"`
+}
+
+func (s *server) handlePVLimit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, ok := s.pvLimiter(w, r)
+		if !ok {
+			return
+		}
+
+		var req pvLimitRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeErrorStatus(w, errors.Wrap(err, "error decoding limit"), http.StatusBadRequest)
+			return
+		}
+
+		err = l.LimitPV(r.Context(), req.Address, req.Limit, time.Duration(req.Timeout*float64(time.Second)))
+		if err != nil {
+			writeErrorStatus(w, err, pvErrorStatus(err))
+			return
+		}
+
+		writeJSON(w, req)
+	}
+}
+
+func (s *server) handlePVLimitRemove() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, ok := s.pvLimiter(w, r)
+		if !ok {
+			return
+		}
+
+		err := l.RemovePVLimit(r.Context(), r.URL.Query().Get("address"))
+		if err != nil {
+			writeErrorStatus(w, err, pvErrorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// pvLimiter returns the limiter of the plant of the request, or writes an error if there is none.
+func (s *server) pvLimiter(w http.ResponseWriter, r *http.Request) (PVLimiter, bool) {
+	name := mux.Vars(r)["name"]
+	if _, ok := s.plants[name]; !ok {
+		writeErrorStatus(w, fmt.Errorf("plant %v not found", name), http.StatusNotFound)
+		return nil, false
+	}
+
+	l, ok := s.pv[name]
+	if !ok {
+		writeErrorStatus(w, fmt.Errorf("plant %v has no limitable PV inverters", name), http.StatusForbidden)
+		return nil, false
+	}
+	return l, true
+}
+
+func pvErrorStatus(err error) int {
+	if errors.Is(err, plant.ErrExportControlled) {
+		return http.StatusConflict
+	}
+	return batteryErrorStatus(err)
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dummyPVLimiter struct {
+	err error
+
+	m       sync.Mutex
+	addr    string
+	pct     float64
+	timeout time.Duration
+	removed bool
+}
+
+func (d *dummyPVLimiter) LimitPV(ctx context.Context, addr string, pct float64, timeout time.Duration) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.addr, d.pct, d.timeout = addr, pct, timeout
+	return d.err
+}
+
+func (d *dummyPVLimiter) RemovePVLimit(ctx context.Context, addr string) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.addr, d.removed = addr, true
+	return d.err
+}
+
+func TestServer_handlePVLimit(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		plant string
+		body  string
+		// contentType defaults to application/json
+		contentType string
+		limiter     *dummyPVLimiter
+		exStatus    int
+		exAddr      string
+		exPct       float64
+		exTimeout   time.Duration
+	}{
+		{
+			name:      "Limit",
+			plant:     "plant1",
+			body:      `{"address": "inverter", "limit": 70, "timeout": 600}`,
+			limiter:   &dummyPVLimiter{},
+			exStatus:  http.StatusOK,
+			exAddr:    "inverter",
+			exPct:     70,
+			exTimeout: 10 * time.Minute,
+		},
+		{
+			name:        "TextPlain",
+			plant:       "plant1",
+			body:        `{"limit": 10}`,
+			contentType: "text/plain",
+			limiter:     &dummyPVLimiter{},
+			exStatus:    http.StatusUnsupportedMediaType,
+		},
+		{
+			name:     "InvalidBody",
+			plant:    "plant1",
+			body:     `{"limit": "half"}`,
+			limiter:  &dummyPVLimiter{},
+			exStatus: http.StatusBadRequest,
+		},
+		{
+			name:     "InvalidLimit",
+			plant:    "plant1",
+			body:     `{"limit": 200}`,
+			limiter:  &dummyPVLimiter{err: errors.Wrap(plant.ErrInvalidSetpoint, "too high")},
+			exStatus: http.StatusBadRequest,
+		},
+		{
+			name:     "ExportControlled",
+			plant:    "plant1",
+			body:     `{"limit": 50}`,
+			limiter:  &dummyPVLimiter{err: plant.ErrExportControlled},
+			exStatus: http.StatusConflict,
+		},
+		{
+			name:     "NotLimitable",
+			plant:    "plant2",
+			body:     `{"limit": 50}`,
+			limiter:  &dummyPVLimiter{},
+			exStatus: http.StatusForbidden,
+		},
+		{
+			name:     "UnknownPlant",
+			plant:    "unknown",
+			body:     `{"limit": 50}`,
+			limiter:  &dummyPVLimiter{},
+			exStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewServer(
+				map[string]PlantFetcher{"plant1": &dummyPlantFetcher{}, "plant2": &dummyPlantFetcher{}},
+				WithPVControl(map[string]PVLimiter{"plant1": tt.limiter}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/v1/plants/"+tt.plant+"/pv/limit", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			s.ServeHTTP(rec, req)
+
+			if rec.Code != tt.exStatus {
+				t.Fatalf("expected status %v, got %v", tt.exStatus, rec.Code)
+			}
+			if tt.exStatus == http.StatusUnsupportedMediaType && tt.limiter.pct != 0 {
+				t.Fatalf("expected no limit, got %+v", tt.limiter)
+			}
+			if tt.exStatus != http.StatusOK {
+				return
+			}
+
+			if tt.limiter.addr != tt.exAddr || tt.limiter.pct != tt.exPct || tt.limiter.timeout != tt.exTimeout {
+				t.Fatalf("expected limit of %v%% for %v at %v, got %+v", tt.exPct, tt.exTimeout, tt.exAddr, tt.limiter)
+			}
+		})
+	}
+}
+
+func TestServer_handlePVLimitRemove(t *testing.T) {
+	t.Parallel()
+
+	l := &dummyPVLimiter{}
+	s, err := NewServer(
+		map[string]PlantFetcher{"plant1": &dummyPlantFetcher{}},
+		WithPVControl(map[string]PVLimiter{"plant1": l}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/plants/plant1/pv/limit?address=inverter", nil))
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %v, got %v", http.StatusNoContent, rec.Code)
+	}
+	if !l.removed || l.addr != "inverter" {
+		t.Fatalf("expected limit to be removed, got %+v", l)
+	}
+}
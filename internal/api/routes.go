@@ -1,12 +1,65 @@
 package api
 
 import (
+	"fmt"
 	"github.com/gorilla/handlers"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"mime"
+	"net/http"
 )
 
 func (s *server) routes() {
-	s.router.Use(handlers.CORS())
+	// control endpoints change the state of devices, so they are not available to other origins via CORS
+	control := s.router.PathPrefix("/v1").Subrouter()
 
-	r := s.router.PathPrefix("/v1")
-	r.HandlerFunc(s.handlePlantSummary()).Path("/summary")
+	if s.batteries != nil {
+		control.Handle("/plants/{name}/battery/setpoint", requireJSON(s.handleBatterySetpoint())).
+			Methods(http.MethodPost)
+		control.HandleFunc("/plants/{name}/battery/setpoint", s.handleBatteryRevert()).Methods(http.MethodDelete)
+	}
+
+	if s.pv != nil {
+		control.Handle("/plants/{name}/pv/limit", requireJSON(s.handlePVLimit())).Methods(http.MethodPost)
+		control.HandleFunc("/plants/{name}/pv/limit", s.handlePVLimitRemove()).Methods(http.MethodDelete)
+	}
+
+	public := s.router.NewRoute().Subrouter()
+	public.Use(handlers.CORS())
+	public.Handle("/metrics", promhttp.Handler())
+	public.HandleFunc("/healthz", s.handleHealth())
+	public.HandleFunc("/readyz", s.handleReady())
+
+	r := public.PathPrefix("/v1").Subrouter()
+	r.HandleFunc("/summary", s.handleSummary())
+	r.HandleFunc("/summary/stream", s.handleSummaryStream())
+	r.HandleFunc("/ws", s.handleWebsocket())
+	r.HandleFunc("/plants/{name}/summary", s.handlePlantSummary())
+	r.HandleFunc("/plants/{name}/grid", s.handlePlantGrid())
+
+	if s.history != nil {
+		r.HandleFunc("/plants/{name}/history", s.handlePlantHistory())
+	}
+
+	if s.devices != nil {
+		r.HandleFunc("/plants/{name}/devices", s.handlePlantDevices())
+	}
+
+	if s.energy != nil {
+		r.HandleFunc("/plants/{name}/energy", s.handlePlantEnergy())
+	}
+}
+
+// requireJSON rejects requests without a JSON body with 415.
+//
+// Browsers send cross-origin requests with other content types, e.g. text/plain, without a CORS preflight, so the
+// request would reach the handler even though the origin isn't allowed.
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || t != "application/json" {
+			writeErrorStatus(w, fmt.Errorf("content type must be application/json"), http.StatusUnsupportedMediaType)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
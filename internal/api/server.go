@@ -3,25 +3,67 @@ package api
 import (
 	"context"
 	"github.com/gorilla/mux"
+	"github.com/orlopau/go-sma-api/internal/energy"
+	"github.com/orlopau/go-sma-api/internal/history"
 	"github.com/orlopau/go-sma-api/internal/plant"
 	"net/http"
+	"time"
 )
 
 type PlantFetcher interface {
 	FetchSummary() (plant.Summary, error)
+	// Subscribe returns a channel receiving new summaries and a function closing the subscription.
+	Subscribe() (<-chan plant.Summary, func())
+}
+
+// HistoryQuerier queries stored summaries of plants.
+type HistoryQuerier interface {
+	Query(name string, from, to time.Time, step time.Duration) ([]history.Point, time.Duration, error)
+}
+
+// EnergyTotaler provides energy totals of plants.
+type EnergyTotaler interface {
+	Totals(name string, now time.Time) energy.Periods
+}
+
+// Option configures optional features of the server.
+type Option func(s *server)
+
+// WithHistory enables the history endpoint.
+func WithHistory(h HistoryQuerier) Option {
+	return func(s *server) {
+		s.history = h
+	}
+}
+
+// WithEnergy enables the energy endpoint.
+func WithEnergy(e EnergyTotaler) Option {
+	return func(s *server) {
+		s.energy = e
+	}
 }
 
 type server struct {
-	plants map[string]PlantFetcher
-	router *mux.Router
-	ctx    context.Context
+	plants      map[string]PlantFetcher
+	history     HistoryQuerier
+	energy      EnergyTotaler
+	devices     map[string]DeviceLister
+	batteries   map[string]BatteryController
+	pv          map[string]PVLimiter
+	readyMaxAge time.Duration
+	router      *mux.Router
+	ctx         context.Context
 }
 
-func NewServer(plants map[string]PlantFetcher) (*server, error) {
+func NewServer(plants map[string]PlantFetcher, opts ...Option) (*server, error) {
 	r := mux.NewRouter()
 	s := &server{
-		plants: plants,
-		router: r,
+		plants:      plants,
+		readyMaxAge: defaultReadyMaxAge,
+		router:      r,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 	s.routes()
 	return s, nil
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// sseHeartbeatInterval is the interval in which comments are sent to keep idle connections open.
+const sseHeartbeatInterval = 15 * time.Second
+
+type plantSummary struct {
+	name    string
+	summary plant.Summary
+}
+
+type streamEvent struct {
+	Plant string `json:"plant"`
+	summaryResponse
+}
+
+// subscribeAll merges the summaries of all plants into a single channel until the context is done.
+func (s *server) subscribeAll(ctx context.Context) <-chan plantSummary {
+	summaries := make(chan plantSummary)
+
+	for k, v := range s.plants {
+		c, unsubscribe := v.Subscribe()
+		go func(name string, c <-chan plant.Summary, unsubscribe func()) {
+			defer unsubscribe()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case summary, ok := <-c:
+					if !ok {
+						return
+					}
+					select {
+					case summaries <- plantSummary{name: name, summary: summary}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(k, c, unsubscribe)
+	}
+
+	return summaries
+}
+
+// timestampMillis returns the end timestamp of the summary in milliseconds.
+func timestampMillis(summary plant.Summary) int64 {
+	return summary.TimestampEnd.UnixNano() / int64(time.Millisecond)
+}
+
+// streamID is the id of server-sent events, the end timestamp in milliseconds of the last summary sent per plant.
+// Plants publish independently, so a single timestamp can't tell which summaries of each plant a client received.
+type streamID map[string]int64
+
+// parseStreamID parses an id encoded as query string, e.g. p1=1608579392000&p2=1608579393000.
+func parseStreamID(s string) (streamID, error) {
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make(streamID, len(values))
+	for k, v := range values {
+		ms, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("plant %v", k))
+		}
+		id[k] = ms
+	}
+	return id, nil
+}
+
+func (id streamID) String() string {
+	values := make(url.Values, len(id))
+	for k, v := range id {
+		values.Set(k, strconv.FormatInt(v, 10))
+	}
+	return values.Encode()
+}
+
+func (s *server) handleSummaryStream() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, fmt.Errorf("streaming is not supported"))
+			return
+		}
+
+		id, err := parseStreamID(r.Header.Get("Last-Event-ID"))
+		if err != nil {
+			writeErrorStatus(w, errors.Wrap(err, "invalid Last-Event-ID"), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		summaries := s.subscribeAll(ctx)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		// send the current state of each plant, unless the client already received it
+		for k, v := range s.plants {
+			summary, err := v.FetchSummary()
+			if err != nil {
+				continue
+			}
+			if err := writeEvent(w, id, k, summary); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			var err error
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.C:
+				_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			case ps := <-summaries:
+				err = writeEvent(w, id, ps.name, ps.summary)
+			}
+
+			if err != nil {
+				log.Println(errors.Wrap(err, "error writing event"))
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes the summary of the plant unless it isn't newer than the last one sent, and updates id.
+func writeEvent(w http.ResponseWriter, id streamID, name string, summary plant.Summary) error {
+	ms := timestampMillis(summary)
+	if last, ok := id[name]; ok && ms <= last {
+		return nil
+	}
+
+	jsn, err := json.Marshal(streamEvent{Plant: name, summaryResponse: newSummaryResponse(summary)})
+	if err != nil {
+		return errors.Wrap(err, "error encoding json")
+	}
+
+	id[name] = ms
+	_, err = fmt.Fprintf(w, "id: %v\ndata: %s\n\n", id, jsn)
+	return err
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads lines until a complete server-sent event is received, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (id string, event streamEvent) {
+	t.Helper()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+		case line == "" && event.Plant != "":
+			return id, event
+		}
+	}
+}
+
+func TestServer_handleSummaryStream(t *testing.T) {
+	t.Parallel()
+
+	// the plants publish out of step
+	start := time.Unix(1608579392, 0)
+	p1 := &dummyPlantFetcher{summary: plant.Summary{PV: 100, TimestampEnd: start}}
+	p2 := &dummyPlantFetcher{summary: plant.Summary{PV: 100, TimestampEnd: start.Add(5 * time.Second)}}
+	s := newDummyServer(t, map[string]PlantFetcher{"p1": p1, "p2": p2})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	tests := []struct {
+		name            string
+		lastEventID     string
+		exInitialPlants int
+	}{
+		{name: "InitialState", exInitialPlants: 2},
+		{name: "LastEventID", lastEventID: "p1=1608579392000&p2=1608579397000"},
+		{name: "LastEventIDOfOnePlant", lastEventID: "p2=1608579397000", exInitialPlants: 1},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/v1/summary/stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.lastEventID != "" {
+			req.Header.Set("Last-Event-ID", tt.lastEventID)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("%v: unexpected content type %v", tt.name, ct)
+		}
+
+		waitFor(t, func() bool { return p1.subscribers() == 1 && p2.subscribers() == 1 })
+		p1.publish(plant.Summary{PV: 200, TimestampEnd: start.Add(time.Second)})
+
+		r := bufio.NewReader(res.Body)
+		for i := 0; i < tt.exInitialPlants; i++ {
+			_, event := readEvent(t, r)
+			if event.PV != 100 {
+				t.Fatalf("%v: unexpected initial event %+v", tt.name, event)
+			}
+		}
+		id, event := readEvent(t, r)
+		if event.Plant != "p1" || event.PV != 200 {
+			t.Fatalf("%v: unexpected event %+v", tt.name, event)
+		}
+		if id != "p1=1608579393000&p2=1608579397000" {
+			t.Fatalf("%v: unexpected event id %v", tt.name, id)
+		}
+
+		cancel()
+		_ = res.Body.Close()
+		waitFor(t, func() bool { return p1.subscribers() == 0 && p2.subscribers() == 0 })
+	}
+}
+
+func TestServer_handleSummaryStream_invalidLastEventID(t *testing.T) {
+	t.Parallel()
+
+	s := newDummyServer(t, map[string]PlantFetcher{"p1": &dummyPlantFetcher{}})
+	req := httptest.NewRequest(http.MethodGet, "/v1/summary/stream", nil)
+	req.Header.Set("Last-Event-ID", "p1=yesterday")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %v, got %v", http.StatusBadRequest, rec.Code)
+	}
+}
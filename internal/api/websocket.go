@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+const (
+	wsTypeSubscribe   = "subscribe"
+	wsTypeUnsubscribe = "unsubscribe"
+	wsTypeSubscribed  = "subscribed"
+	wsTypeSummary     = "summary"
+	wsTypeError       = "error"
+)
+
+var upgrader = websocket.Upgrader{
+	// CORS is allowed for all origins, the same applies to websockets
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsRequest is a message sent by the client.
+type wsRequest struct {
+	Type   string   `json:"type"`
+	Plants []string `json:"plants"`
+}
+
+// wsMessage is a message sent to the client.
+type wsMessage struct {
+	Type    string           `json:"type"`
+	Plant   string           `json:"plant,omitempty"`
+	Plants  []string         `json:"plants,omitempty"`
+	Data    *summaryResponse `json:"data,omitempty"`
+	Message string           `json:"message,omitempty"`
+}
+
+// wsClient holds the subscriptions of a single websocket connection.
+//
+// Summaries are never queued, only the latest summary of each plant is kept until it is written. This way a slow client
+// only misses stale summaries and never blocks fetching.
+type wsClient struct {
+	conn *websocket.Conn
+
+	mu      sync.Mutex
+	subs    map[string]context.CancelFunc
+	pending map[string]plant.Summary
+
+	notify  chan struct{}
+	replies chan wsMessage
+}
+
+func (s *server) handleWebsocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println(errors.Wrap(err, "error upgrading websocket"))
+			return
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		c := &wsClient{
+			conn:    conn,
+			subs:    make(map[string]context.CancelFunc),
+			pending: make(map[string]plant.Summary),
+			notify:  make(chan struct{}, 1),
+			replies: make(chan wsMessage, 16),
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			err := c.writeLoop(ctx)
+			if err != nil {
+				log.Println(errors.Wrap(err, "error writing websocket"))
+			}
+		}()
+
+		c.readLoop(ctx, s.plants)
+
+		cancel()
+		wg.Wait()
+		c.unsubscribeAll()
+	}
+}
+
+func (c *wsClient) readLoop(ctx context.Context, plants map[string]PlantFetcher) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var req wsRequest
+		err := c.conn.ReadJSON(&req)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(errors.Wrap(err, "error reading websocket"))
+			}
+			return
+		}
+
+		switch req.Type {
+		case wsTypeSubscribe:
+			for _, name := range req.Plants {
+				p, ok := plants[name]
+				if !ok {
+					c.reply(ctx, wsMessage{Type: wsTypeError, Message: fmt.Sprintf("plant %v not found", name)})
+					continue
+				}
+				c.subscribe(ctx, name, p)
+			}
+		case wsTypeUnsubscribe:
+			for _, name := range req.Plants {
+				c.unsubscribe(name)
+			}
+		default:
+			c.reply(ctx, wsMessage{Type: wsTypeError, Message: fmt.Sprintf("unknown message type %v", req.Type)})
+			continue
+		}
+
+		c.reply(ctx, wsMessage{Type: wsTypeSubscribed, Plants: c.subscriptions()})
+	}
+}
+
+func (c *wsClient) writeLoop(ctx context.Context) error {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			_ = c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+			return nil
+		case <-ping.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			if err != nil {
+				return err
+			}
+		case msg := <-c.replies:
+			err := c.write(msg)
+			if err != nil {
+				return err
+			}
+		case <-c.notify:
+			c.mu.Lock()
+			pending := c.pending
+			c.pending = make(map[string]plant.Summary, len(pending))
+			c.mu.Unlock()
+
+			for name, summary := range pending {
+				res := newSummaryResponse(summary)
+				err := c.write(wsMessage{Type: wsTypeSummary, Plant: name, Data: &res})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (c *wsClient) write(msg wsMessage) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(msg)
+}
+
+func (c *wsClient) reply(ctx context.Context, msg wsMessage) {
+	select {
+	case c.replies <- msg:
+	case <-ctx.Done():
+	}
+}
+
+// push replaces the pending summary of a plant and wakes up the writer.
+func (c *wsClient) push(name string, summary plant.Summary) {
+	c.mu.Lock()
+	if _, ok := c.subs[name]; !ok {
+		c.mu.Unlock()
+		return
+	}
+	c.pending[name] = summary
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *wsClient) subscribe(ctx context.Context, name string, p PlantFetcher) {
+	c.mu.Lock()
+	if _, ok := c.subs[name]; ok {
+		c.mu.Unlock()
+		return
+	}
+	subCtx, cancel := context.WithCancel(ctx)
+	c.subs[name] = cancel
+	c.mu.Unlock()
+
+	summaries, unsubscribe := p.Subscribe()
+	go func() {
+		defer unsubscribe()
+		for {
+			select {
+			case <-subCtx.Done():
+				return
+			case summary, ok := <-summaries:
+				if !ok {
+					return
+				}
+				c.push(name, summary)
+			}
+		}
+	}()
+
+	// send the current summary right away, instead of waiting for the next one
+	summary, err := p.FetchSummary()
+	if err == nil {
+		c.push(name, summary)
+	}
+}
+
+func (c *wsClient) unsubscribe(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cancel, ok := c.subs[name]
+	if !ok {
+		return
+	}
+	cancel()
+	delete(c.subs, name)
+	delete(c.pending, name)
+}
+
+func (c *wsClient) unsubscribeAll() {
+	for _, name := range c.subscriptions() {
+		c.unsubscribe(name)
+	}
+}
+
+func (c *wsClient) subscriptions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.subs))
+	for k := range c.subs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
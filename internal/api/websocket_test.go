@@ -0,0 +1,150 @@
+package api
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dialWebsocket(t *testing.T, s *server) (*websocket.Conn, func()) {
+	t.Helper()
+
+	ts := httptest.NewServer(s)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/v1/ws", nil)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+
+	return conn, func() {
+		_ = conn.Close()
+		ts.Close()
+	}
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn, msgType string) wsMessage {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var msg wsMessage
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestServer_handleWebsocket(t *testing.T) {
+	t.Parallel()
+
+	p1 := &dummyPlantFetcher{summary: plant.Summary{PV: 100}}
+	p2 := &dummyPlantFetcher{err: plant.ErrNoData}
+	s := newDummyServer(t, map[string]PlantFetcher{"p1": p1, "p2": p2})
+
+	conn, closeConn := dialWebsocket(t, s)
+	defer closeConn()
+
+	err := conn.WriteJSON(wsRequest{Type: wsTypeSubscribe, Plants: []string{"p1", "p2", "unknown"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// summaries are written independently of replies, the order is not guaranteed
+	msgs := make(map[string]wsMessage)
+	for len(msgs) < 3 {
+		var msg wsMessage
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs[msg.Type] = msg
+	}
+
+	if msg := msgs[wsTypeError]; !strings.Contains(msg.Message, "unknown") {
+		t.Fatalf("expected error for unknown plant, got %+v", msg)
+	}
+	if msg := msgs[wsTypeSubscribed]; len(msg.Plants) != 2 {
+		t.Fatalf("expected two subscriptions, got %+v", msg)
+	}
+	// current summary of p1 is sent on subscribe, p2 has no data yet
+	if msg := msgs[wsTypeSummary]; msg.Plant != "p1" || msg.Data.PV != 100 {
+		t.Fatalf("unexpected summary %+v", msg)
+	}
+
+	waitFor(t, func() bool { return p2.subscribers() == 1 })
+	p2.publish(plant.Summary{PV: 200})
+	msg := readMessage(t, conn, wsTypeSummary)
+	if msg.Plant != "p2" || msg.Data.PV != 200 {
+		t.Fatalf("unexpected summary %+v", msg)
+	}
+
+	err = conn.WriteJSON(wsRequest{Type: wsTypeUnsubscribe, Plants: []string{"p2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = readMessage(t, conn, wsTypeSubscribed)
+	if len(msg.Plants) != 1 || msg.Plants[0] != "p1" {
+		t.Fatalf("expected subscription of p1 only, got %+v", msg)
+	}
+	waitFor(t, func() bool { return p2.subscribers() == 0 })
+
+	// closing the connection removes all subscriptions
+	_ = conn.Close()
+	waitFor(t, func() bool { return p1.subscribers() == 0 })
+}
+
+func TestServer_handleWebsocket_slowClient(t *testing.T) {
+	t.Parallel()
+
+	p1 := &dummyPlantFetcher{err: plant.ErrNoData}
+	s := newDummyServer(t, map[string]PlantFetcher{"p1": p1})
+
+	conn, closeConn := dialWebsocket(t, s)
+	defer closeConn()
+
+	err := conn.WriteJSON(wsRequest{Type: wsTypeSubscribe, Plants: []string{"p1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readMessage(t, conn, wsTypeSubscribed)
+
+	// publishing must not block while the client doesn't read
+	const published = 1000
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i <= published; i++ {
+			p1.publish(plant.Summary{PV: float32(i)})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishing blocked by slow client")
+	}
+
+	var received int
+	var last float32
+	for last != published {
+		msg := readMessage(t, conn, wsTypeSummary)
+		received++
+		if msg.Data.PV <= last {
+			t.Fatalf("received summary %v after %v", msg.Data.PV, last)
+		}
+		last = msg.Data.PV
+	}
+
+	// intermediate summaries are dropped instead of queued
+	if received >= published {
+		t.Fatalf("expected summaries to be dropped, received all %v", received)
+	}
+}
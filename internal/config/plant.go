@@ -2,14 +2,117 @@ package config
 
 import (
 	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
 	"github.com/spf13/viper"
 	"log"
 	"strings"
+	"time"
 )
 
+// Grid sources of a plant.
+const (
+	// GridEnergyMeter uses the SMA energy meter with the configured serial number.
+	GridEnergyMeter = "energymeter"
+	// GridSunSpec uses a SunSpec meter among the SunSpec devices, if any.
+	GridSunSpec = "sunspec"
+)
+
+// defaultBatteryTimeout is the maximum time until a battery setpoint is reverted, if not configured.
+const defaultBatteryTimeout = 15 * time.Minute
+
 type Plant struct {
-	SunSpecAddrs    []string `mapstructure:"sunspec"`
-	EnergyMeterSN   uint32   `mapstructure:"energymeter"`
+	SunSpecAddrs []string `mapstructure:"sunspec"`
+	// EnergyMeterSN is 0 if the plant has no energy meter.
+	EnergyMeterSN uint32 `mapstructure:"energymeter"`
+	// Grid is the source of the grid power, see GridSource.
+	Grid      string    `mapstructure:"grid"`
+	Batteries []Battery `mapstructure:"batteries"`
+	// Interval is the minimum time between two fetches, plants without an energy meter are fetched every second by
+	// default.
+	Interval time.Duration `mapstructure:"interval"`
+	// GracePeriod is the time the last summary is served after fetches started failing, 0 to fail immediately.
+	GracePeriod time.Duration `mapstructure:"gracePeriod"`
+	// StaleAfter is the age after which summaries are marked as stale, 0 for the default.
+	StaleAfter time.Duration `mapstructure:"staleAfter"`
+	// PVLimit allows limiting the active power of the PV inverters.
+	PVLimit bool `mapstructure:"pvLimit"`
+	// ExportLimit is the maximum power fed into the grid in W, nil to not control the export. Implies PVLimit.
+	ExportLimit *float64 `mapstructure:"exportLimit"`
+	// Rules switch loads depending on the summaries of the plant.
+	Rules []Rule `mapstructure:"rules"`
+}
+
+// Battery configures a battery inverter of a plant, identified by its SunSpec address.
+type Battery struct {
+	Address string `mapstructure:"address"`
+	// Capacity is the usable capacity in Wh, used to weight the SoC of multiple batteries.
+	Capacity float64 `mapstructure:"capacity"`
+	// Control enables setpoints for the battery, nil if the battery must not be controlled.
+	Control *BatteryControl `mapstructure:"control"`
+}
+
+// BatteryControl bounds the setpoints of a battery.
+type BatteryControl struct {
+	// MaxChargePower and MaxDischargePower bound the power limits in W, defaulting to the rated power.
+	MaxChargePower    float64 `mapstructure:"maxChargePower"`
+	MaxDischargePower float64 `mapstructure:"maxDischargePower"`
+	// MinReserve and MaxReserve bound the minimum reserve SoC in percent, defaulting to 0 and 100.
+	MinReserve float64 `mapstructure:"minReserve"`
+	MaxReserve float64 `mapstructure:"maxReserve"`
+	// Timeout is the maximum time until a setpoint is reverted, also used for setpoints without a timeout.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// GridSource returns the configured source of the grid power. Defaults to GridEnergyMeter if a serial number is
+// configured, GridSunSpec otherwise.
+func (p Plant) GridSource() string {
+	if p.Grid != "" {
+		return p.Grid
+	}
+	if p.EnergyMeterSN != 0 {
+		return GridEnergyMeter
+	}
+	return GridSunSpec
+}
+
+// LimitsPV returns true if the active power of the PV inverters may be limited.
+func (p Plant) LimitsPV() bool {
+	return p.PVLimit || p.ExportLimit != nil
+}
+
+// BatteryCapacity returns the configured capacity of the battery at the address, 0 if not configured.
+func (p Plant) BatteryCapacity(addr string) float64 {
+	for _, b := range p.Batteries {
+		if b.Address == addr {
+			return b.Capacity
+		}
+	}
+	return 0
+}
+
+// BatteryLimits returns the bounds of setpoints of the battery at the address, nil if it must not be controlled.
+func (p Plant) BatteryLimits(addr string) *plant.BatteryLimits {
+	for _, b := range p.Batteries {
+		if b.Address != addr || b.Control == nil {
+			continue
+		}
+
+		limits := &plant.BatteryLimits{
+			MaxChargePower:    b.Control.MaxChargePower,
+			MaxDischargePower: b.Control.MaxDischargePower,
+			MinReserve:        b.Control.MinReserve,
+			MaxReserve:        b.Control.MaxReserve,
+			MaxTimeout:        b.Control.Timeout,
+		}
+		if limits.MaxReserve == 0 {
+			limits.MaxReserve = 100
+		}
+		if limits.MaxTimeout == 0 {
+			limits.MaxTimeout = defaultBatteryTimeout
+		}
+		return limits
+	}
+	return nil
 }
 
 type Plants map[string]Plant
@@ -23,6 +126,37 @@ func (p Plants) String() string {
 			b.WriteString(fmt.Sprintf("    - %s\n", addr))
 		}
 		b.WriteString(fmt.Sprintf("  Energymeter serial number: %v\n", v.EnergyMeterSN))
+		b.WriteString(fmt.Sprintf("  Grid source: %v\n", v.GridSource()))
+		if v.Interval != 0 {
+			b.WriteString(fmt.Sprintf("  Fetch interval: %v\n", v.Interval))
+		}
+		if v.GracePeriod != 0 {
+			b.WriteString(fmt.Sprintf("  Grace period: %v\n", v.GracePeriod))
+		}
+		if v.StaleAfter != 0 {
+			b.WriteString(fmt.Sprintf("  Stale after: %v\n", v.StaleAfter))
+		}
+		if v.ExportLimit != nil {
+			b.WriteString(fmt.Sprintf("  Export limit: %v W\n", *v.ExportLimit))
+		} else if v.PVLimit {
+			b.WriteString(fmt.Sprintln("  PV limit: enabled"))
+		}
+		if len(v.Rules) > 0 {
+			b.WriteString(fmt.Sprintln("  Rules:"))
+			for _, r := range v.Rules {
+				b.WriteString(fmt.Sprintf("    - %s\n", r.Name))
+			}
+		}
+		if len(v.Batteries) > 0 {
+			b.WriteString(fmt.Sprintln("  Batteries:"))
+			for _, bat := range v.Batteries {
+				control := ""
+				if bat.Control != nil {
+					control = ", controllable"
+				}
+				b.WriteString(fmt.Sprintf("    - %s: %v Wh%s\n", bat.Address, bat.Capacity, control))
+			}
+		}
 	}
 
 	return b.String()
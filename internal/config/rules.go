@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/rules"
+	"time"
+)
+
+// Rule switches a load depending on the summaries of the plant, see rules.Rule.
+// Exactly one of the actuators Webhook, MQTT and Modbus must be set.
+type Rule struct {
+	Name       string        `mapstructure:"name"`
+	Conditions []Condition   `mapstructure:"conditions"`
+	MinOn      time.Duration `mapstructure:"minOn"`
+	MinOff     time.Duration `mapstructure:"minOff"`
+
+	Webhook *Webhook    `mapstructure:"webhook"`
+	MQTT    *MQTT       `mapstructure:"mqtt"`
+	Modbus  *ModbusCoil `mapstructure:"modbus"`
+}
+
+// Condition compares a value of the summaries to a threshold, see rules.Condition.
+type Condition struct {
+	Value      string        `mapstructure:"value"`
+	Below      *float64      `mapstructure:"below"`
+	Above      *float64      `mapstructure:"above"`
+	Hysteresis float64       `mapstructure:"hysteresis"`
+	For        time.Duration `mapstructure:"for"`
+}
+
+// Webhook configures a rules.Webhook.
+type Webhook struct {
+	URL    string `mapstructure:"url"`
+	Method string `mapstructure:"method"`
+}
+
+// MQTT configures a rules.MQTT actuator publishing to the broker, e.g. tcp://localhost:1883.
+type MQTT struct {
+	Broker string `mapstructure:"broker"`
+	Topic  string `mapstructure:"topic"`
+	On     string `mapstructure:"on"`
+	Off    string `mapstructure:"off"`
+	QoS    byte   `mapstructure:"qos"`
+	Retain bool   `mapstructure:"retain"`
+}
+
+// ModbusCoil configures a rules.ModbusCoil.
+type ModbusCoil struct {
+	Address string `mapstructure:"address"`
+	SlaveID byte   `mapstructure:"slaveId"`
+	Coil    uint16 `mapstructure:"coil"`
+}
+
+// Rule returns the rule with the actuator, which must match the configured one.
+func (r Rule) Rule(a rules.Actuator) (*rules.Rule, error) {
+	actuators := 0
+	for _, set := range []bool{r.Webhook != nil, r.MQTT != nil, r.Modbus != nil} {
+		if set {
+			actuators++
+		}
+	}
+	if actuators != 1 {
+		return nil, fmt.Errorf("rule %v must have exactly one of webhook, mqtt and modbus", r.Name)
+	}
+
+	conditions := make([]rules.Condition, len(r.Conditions))
+	for i, c := range r.Conditions {
+		conditions[i] = rules.Condition{
+			Value:      c.Value,
+			Below:      c.Below,
+			Above:      c.Above,
+			Hysteresis: c.Hysteresis,
+			For:        c.For,
+		}
+	}
+
+	rule := &rules.Rule{
+		Name:       r.Name,
+		Conditions: conditions,
+		MinOn:      r.MinOn,
+		MinOff:     r.MinOff,
+		Actuator:   a,
+	}
+	return rule, rule.Validate()
+}
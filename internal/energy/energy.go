@@ -0,0 +1,290 @@
+// Package energy integrates the power of plant summaries into energy totals.
+package energy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// maxGap is the maximum duration between two summaries which is integrated.
+	// Longer gaps, e.g. due to a restart or an offline plant, are skipped as the power in between is unknown.
+	maxGap = time.Minute
+	// saveInterval is the interval in which the totals are persisted.
+	saveInterval = time.Minute
+)
+
+// Totals contains energy amounts in Wh.
+type Totals struct {
+	PV           float64 `json:"pv"`
+	GridImport   float64 `json:"gridImport"`
+	GridExport   float64 `json:"gridExport"`
+	BatCharge    float64 `json:"batteryCharge"`
+	BatDischarge float64 `json:"batteryDischarge"`
+	Consumption  float64 `json:"consumption"`
+}
+
+func (t *Totals) add(o Totals) {
+	t.PV += o.PV
+	t.GridImport += o.GridImport
+	t.GridExport += o.GridExport
+	t.BatCharge += o.BatCharge
+	t.BatDischarge += o.BatDischarge
+	t.Consumption += o.Consumption
+}
+
+// Period contains the totals since the start of a day, month or year.
+type Period struct {
+	Start time.Time `json:"start"`
+	Totals
+}
+
+// Periods contains the totals of the current day, month and year.
+type Periods struct {
+	Day   Period `json:"day"`
+	Month Period `json:"month"`
+	Year  Period `json:"year"`
+}
+
+// sample is the power of a summary, used as the last point of integration.
+type sample struct {
+	Time            time.Time `json:"time"`
+	PV              float32   `json:"pv"`
+	Grid            float32   `json:"grid"`
+	Bat             float32   `json:"battery"`
+	SelfConsumption float32   `json:"selfConsumption"`
+	// GridImportEnergy and GridExportEnergy are the readings of the grid meter, 0 if not available.
+	GridImportEnergy float64 `json:"gridImportEnergy,omitempty"`
+	GridExportEnergy float64 `json:"gridExportEnergy,omitempty"`
+	// NoGrid is set if the plant has no grid meter, grid and consumption aren't integrated then.
+	NoGrid bool `json:"noGrid,omitempty"`
+}
+
+type plantState struct {
+	Periods Periods `json:"periods"`
+	Last    *sample `json:"last,omitempty"`
+}
+
+// Integrator integrates the power of summaries into energy totals using the trapezoidal rule.
+//
+// Totals are persisted as JSON in a file, surviving restarts.
+type Integrator struct {
+	path string
+
+	mu     sync.Mutex
+	plants map[string]*plantState
+}
+
+// Open creates an Integrator, loading previously persisted totals from the given path if the file exists.
+func Open(path string) (*Integrator, error) {
+	i := &Integrator{
+		path:   path,
+		plants: make(map[string]*plantState),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return i, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading energy totals")
+	}
+
+	err = json.Unmarshal(data, &i.plants)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding energy totals")
+	}
+
+	return i, nil
+}
+
+// Add integrates the power since the last summary of the plant.
+func (i *Integrator) Add(name string, s plant.Summary) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	st, ok := i.plants[name]
+	if !ok {
+		st = &plantState{}
+		i.plants[name] = st
+	}
+
+	current := sample{
+		Time:             s.TimestampEnd,
+		PV:               s.PV,
+		Grid:             s.Grid,
+		Bat:              s.Bat,
+		SelfConsumption:  s.SelfConsumption,
+		GridImportEnergy: s.GridImportEnergy,
+		GridExportEnergy: s.GridExportEnergy,
+		NoGrid:           !s.HasGrid,
+	}
+
+	if st.Last != nil && !current.Time.After(st.Last.Time) {
+		return
+	}
+
+	st.Periods = rollPeriods(st.Periods, current.Time)
+
+	if st.Last != nil && current.Time.Sub(st.Last.Time) <= maxGap {
+		delta := integrate(*st.Last, current)
+		st.Periods.Day.add(delta)
+		st.Periods.Month.add(delta)
+		st.Periods.Year.add(delta)
+	}
+
+	st.Last = &current
+}
+
+// Totals returns the totals of the plant for the periods containing now.
+//
+// Periods without any integrated summary contain zero totals.
+func (i *Integrator) Totals(name string, now time.Time) Periods {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	st, ok := i.plants[name]
+	if !ok {
+		return rollPeriods(Periods{}, now)
+	}
+
+	return rollPeriods(st.Periods, now)
+}
+
+// Save persists the totals of all plants.
+func (i *Integrator) Save() error {
+	i.mu.Lock()
+	data, err := json.Marshal(i.plants)
+	i.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash never leaves a partially written file
+	tmp, err := ioutil.TempFile(filepath.Dir(i.path), filepath.Base(i.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), i.path)
+}
+
+// Run integrates all summaries of the plants until the context is done, periodically persisting the totals.
+func Run(ctx context.Context, i *Integrator, plants map[string]plant.Subscriber) {
+	for k, v := range plants {
+		go func(name string, p plant.Subscriber) {
+			summaries, unsubscribe := p.Subscribe()
+			defer unsubscribe()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case s, ok := <-summaries:
+					if !ok {
+						return
+					}
+					i.Add(name, s)
+				}
+			}
+		}(k, v)
+	}
+
+	go func() {
+		ticker := time.NewTicker(saveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				err := i.Save()
+				if err != nil {
+					log.Println(errors.Wrap(err, "error saving energy totals"))
+				}
+				return
+			case <-ticker.C:
+				err := i.Save()
+				if err != nil {
+					log.Println(errors.Wrap(err, "error saving energy totals"))
+				}
+			}
+		}
+	}()
+}
+
+// integrate returns the energy between two samples using the trapezoidal rule.
+//
+// If both samples contain meter readings, the grid energy is the difference of the readings instead, which is more
+// accurate than integrating the power.
+func integrate(s1, s2 sample) Totals {
+	hours := s2.Time.Sub(s1.Time).Hours()
+	trapezoid := func(p1, p2 float32) float64 {
+		return (float64(p1) + float64(p2)) / 2 * hours
+	}
+
+	t := Totals{
+		PV:           trapezoid(s1.PV, s2.PV),
+		GridImport:   trapezoid(positive(s1.Grid), positive(s2.Grid)),
+		GridExport:   trapezoid(positive(-s1.Grid), positive(-s2.Grid)),
+		BatCharge:    trapezoid(positive(-s1.Bat), positive(-s2.Bat)),
+		BatDischarge: trapezoid(positive(s1.Bat), positive(s2.Bat)),
+		Consumption:  trapezoid(s1.SelfConsumption, s2.SelfConsumption),
+	}
+
+	if s1.NoGrid || s2.NoGrid {
+		t.GridImport, t.GridExport, t.Consumption = 0, 0, 0
+		return t
+	}
+
+	hasReadings := s1.GridImportEnergy != 0 && s2.GridImportEnergy != 0
+	// a decreasing reading means the meter was reset or replaced
+	if hasReadings && s2.GridImportEnergy >= s1.GridImportEnergy && s2.GridExportEnergy >= s1.GridExportEnergy {
+		t.GridImport = s2.GridImportEnergy - s1.GridImportEnergy
+		t.GridExport = s2.GridExportEnergy - s1.GridExportEnergy
+	}
+
+	return t
+}
+
+func positive(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+// rollPeriods resets all periods which don't contain t.
+func rollPeriods(p Periods, t time.Time) Periods {
+	y, m, d := t.Date()
+	roll := func(period Period, start time.Time) Period {
+		if !period.Start.Equal(start) {
+			return Period{Start: start}
+		}
+		return period
+	}
+
+	p.Day = roll(p.Day, time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	p.Month = roll(p.Month, time.Date(y, m, 1, 0, 0, 0, 0, t.Location()))
+	p.Year = roll(p.Year, time.Date(y, 1, 1, 0, 0, 0, 0, t.Location()))
+	return p
+}
@@ -0,0 +1,127 @@
+package energy
+
+import (
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func equalTotals(t1, t2 Totals) bool {
+	eq := func(a, b float64) bool {
+		return math.Abs(a-b) < 1e-9
+	}
+	return eq(t1.PV, t2.PV) && eq(t1.GridImport, t2.GridImport) && eq(t1.GridExport, t2.GridExport) &&
+		eq(t1.BatCharge, t2.BatCharge) && eq(t1.BatDischarge, t2.BatDischarge) && eq(t1.Consumption, t2.Consumption)
+}
+
+func TestIntegrator(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "energy.json")
+	i, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 12, 31, 23, 59, 0, 0, time.Local)
+	summaries := []plant.Summary{
+		{PV: 1000, Grid: -200, Bat: -300, SelfConsumption: 500, HasGrid: true, TimestampEnd: start},
+		{PV: 3000, Grid: 200, Bat: 300, SelfConsumption: 3500, HasGrid: true, TimestampEnd: start.Add(36 * time.Second)},
+		// ignored, as it isn't newer than the last summary
+		{PV: 10000, TimestampEnd: start.Add(36 * time.Second)},
+		// gaps aren't integrated
+		{PV: 10000, TimestampEnd: start.Add(10 * time.Minute)},
+	}
+
+	for _, s := range summaries[:3] {
+		i.Add("plant1", s)
+	}
+
+	// 36 seconds are 0.01 hours
+	expected := Totals{
+		PV:           20,
+		GridImport:   1,
+		GridExport:   1,
+		BatCharge:    1.5,
+		BatDischarge: 1.5,
+		Consumption:  20,
+	}
+
+	periods := i.Totals("plant1", start)
+	if !equalTotals(periods.Day.Totals, expected) || !equalTotals(periods.Year.Totals, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, periods)
+	}
+
+	// persisted totals are restored
+	err = i.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	periods = i.Totals("plant1", start)
+	if !equalTotals(periods.Month.Totals, expected) {
+		t.Fatalf("expected %+v after restore, got %+v", expected, periods.Month)
+	}
+
+	// the periods are reset in the new year
+	i.Add("plant1", summaries[3])
+	periods = i.Totals("plant1", summaries[3].TimestampEnd)
+	if !equalTotals(periods.Day.Totals, Totals{}) || !equalTotals(periods.Year.Totals, Totals{}) {
+		t.Fatalf("expected reset totals, got %+v", periods)
+	}
+	if !periods.Year.Start.Equal(time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("unexpected year start %v", periods.Year.Start)
+	}
+
+	// unknown plants have zero totals
+	periods = i.Totals("unknown", start)
+	if !equalTotals(periods.Day.Totals, Totals{}) || !periods.Day.Start.Equal(time.Date(2020, 12, 31, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("unexpected totals %+v", periods)
+	}
+}
+
+func TestIntegrator_meterReadings(t *testing.T) {
+	t.Parallel()
+
+	i, err := Open(filepath.Join(t.TempDir(), "energy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 12, 21, 12, 0, 0, 0, time.Local)
+	i.Add("plant1", plant.Summary{Grid: 100, GridImportEnergy: 1000, GridExportEnergy: 500, HasGrid: true, TimestampEnd: start})
+	i.Add("plant1", plant.Summary{Grid: 100, GridImportEnergy: 1002.5, GridExportEnergy: 500, HasGrid: true,
+		TimestampEnd: start.Add(36 * time.Second)})
+
+	// the meter readings take precedence over the integrated power of 1 Wh
+	periods := i.Totals("plant1", start)
+	if periods.Day.GridImport != 2.5 || periods.Day.GridExport != 0 {
+		t.Fatalf("expected grid energy from meter readings, got %+v", periods.Day)
+	}
+}
+
+func TestIntegrator_noGrid(t *testing.T) {
+	t.Parallel()
+
+	i, err := Open(filepath.Join(t.TempDir(), "energy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 12, 21, 12, 0, 0, 0, time.Local)
+	i.Add("plant1", plant.Summary{PV: 1000, TimestampEnd: start})
+	i.Add("plant1", plant.Summary{PV: 1000, TimestampEnd: start.Add(36 * time.Second)})
+
+	// only the PV energy is known
+	expected := Totals{PV: 10}
+	periods := i.Totals("plant1", start)
+	if !equalTotals(periods.Day.Totals, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, periods.Day)
+	}
+}
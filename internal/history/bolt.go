@@ -0,0 +1,259 @@
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// encodedPoint is the binary representation of a Point, the timestamp is stored in the key.
+type encodedPoint struct {
+	Grid, PV, Bat, SelfConsumption, BatPercentage float32
+	Flags                                         uint8
+}
+
+// Flags of encoded points.
+const (
+	flagBattery uint8 = 1 << iota
+	flagGrid
+)
+
+// legacyPointSize is the size of points stored before flags were added, which are decoded with all flags set.
+const legacyPointSize = 5 * 4
+
+// BoltStore is a Store persisting points in an embedded bolt database.
+//
+// Each plant has a bucket containing a bucket for each resolution. Summaries are accumulated in memory and written once
+// the step of a resolution is complete, so an incomplete step is lost on restart.
+type BoltStore struct {
+	db          *bolt.DB
+	resolutions []Resolution
+
+	mu           sync.Mutex
+	accumulators map[string][]accumulator
+}
+
+// OpenBolt opens or creates the bolt database at the given path.
+func OpenBolt(path string, resolutions []Resolution) (*BoltStore, error) {
+	if len(resolutions) == 0 {
+		return nil, fmt.Errorf("at least one resolution is required")
+	}
+
+	resolutions = append([]Resolution(nil), resolutions...)
+	sort.Slice(resolutions, func(i, j int) bool {
+		return resolutions[i].Step < resolutions[j].Step
+	})
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "opening history database")
+	}
+
+	return &BoltStore{
+		db:           db,
+		resolutions:  resolutions,
+		accumulators: make(map[string][]accumulator),
+	}, nil
+}
+
+func (b *BoltStore) Append(name string, s plant.Summary) error {
+	p := pointFromSummary(s)
+
+	b.mu.Lock()
+	accs, ok := b.accumulators[name]
+	if !ok {
+		accs = make([]accumulator, len(b.resolutions))
+		b.accumulators[name] = accs
+	}
+
+	completed := make(map[Resolution]Point)
+	for i, r := range b.resolutions {
+		acc := &accs[i]
+		window := p.Time.Truncate(r.Step)
+		if acc.count > 0 && !window.Equal(acc.window) {
+			completed[r] = acc.average()
+			*acc = accumulator{}
+		}
+		acc.window = window
+		acc.add(p)
+	}
+	b.mu.Unlock()
+
+	if len(completed) == 0 {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for r, p := range completed {
+			bucket, err := resolutionBucket(tx, name, r)
+			if err != nil {
+				return err
+			}
+
+			ep := encodedPoint{
+				Grid:            p.Grid,
+				PV:              p.PV,
+				Bat:             p.Bat,
+				SelfConsumption: p.SelfConsumption,
+				BatPercentage:   p.BatPercentage,
+			}
+			if p.HasBattery {
+				ep.Flags |= flagBattery
+			}
+			if p.HasGrid {
+				ep.Flags |= flagGrid
+			}
+
+			var buf bytes.Buffer
+			err = binary.Write(&buf, binary.BigEndian, ep)
+			if err != nil {
+				return err
+			}
+
+			err = bucket.Put(timeKey(p.Time), buf.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) Query(name string, from, to time.Time, step time.Duration) ([]Point, time.Duration, error) {
+	r := b.resolution(time.Now(), from, step)
+	var points []Point
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		plantBucket := tx.Bucket([]byte(name))
+		if plantBucket == nil {
+			return nil
+		}
+		bucket := plantBucket.Bucket([]byte(r.Step.String()))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		max := timeKey(to)
+		for k, v := c.Seek(timeKey(from)); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
+			ep, err := decodePoint(v)
+			if err != nil {
+				return err
+			}
+
+			points = append(points, Point{
+				Time:            time.Unix(int64(binary.BigEndian.Uint64(k)), 0),
+				Grid:            ep.Grid,
+				PV:              ep.PV,
+				Bat:             ep.Bat,
+				SelfConsumption: ep.SelfConsumption,
+				BatPercentage:   ep.BatPercentage,
+				HasBattery:      ep.Flags&flagBattery != 0,
+				HasGrid:         ep.Flags&flagGrid != 0,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if step <= r.Step {
+		return points, r.Step, nil
+	}
+	return downsample(points, step), step, nil
+}
+
+func (b *BoltStore) Prune(now time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, plantBucket *bolt.Bucket) error {
+			for _, r := range b.resolutions {
+				if r.Retention == 0 {
+					continue
+				}
+
+				bucket := plantBucket.Bucket([]byte(r.Step.String()))
+				if bucket == nil {
+					continue
+				}
+
+				var expired [][]byte
+				c := bucket.Cursor()
+				min := timeKey(now.Add(-r.Retention))
+				for k, _ := c.First(); k != nil && bytes.Compare(k, min) < 0; k, _ = c.Next() {
+					expired = append(expired, k)
+				}
+
+				for _, k := range expired {
+					err := bucket.Delete(k)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// resolution returns the coarsest resolution not exceeding the step, which still contains points at the from time.
+//
+// If all resolutions exceed the step, the finest resolution is used.
+func (b *BoltStore) resolution(now, from time.Time, step time.Duration) Resolution {
+	var (
+		chosen Resolution
+		found  bool
+	)
+
+	// resolutions are sorted by step
+	for _, r := range b.resolutions {
+		if r.Retention != 0 && from.Before(now.Add(-r.Retention)) {
+			continue
+		}
+		if !found || r.Step <= step {
+			chosen = r
+			found = true
+		}
+	}
+
+	if !found {
+		return b.resolutions[len(b.resolutions)-1]
+	}
+
+	return chosen
+}
+
+func resolutionBucket(tx *bolt.Tx, name string, r Resolution) (*bolt.Bucket, error) {
+	plantBucket, err := tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return plantBucket.CreateBucketIfNotExists([]byte(r.Step.String()))
+}
+
+func decodePoint(v []byte) (encodedPoint, error) {
+	if len(v) == legacyPointSize {
+		v = append(append([]byte(nil), v...), ^uint8(0))
+	}
+
+	var ep encodedPoint
+	err := binary.Read(bytes.NewReader(v), binary.BigEndian, &ep)
+	return ep, err
+}
+
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.Unix()))
+	return k
+}
@@ -0,0 +1,239 @@
+package history
+
+import (
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, resolutions string) *BoltStore {
+	t.Helper()
+
+	rs, err := ParseResolutions(resolutions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenBolt(filepath.Join(t.TempDir(), "history.db"), rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	return store
+}
+
+func TestParseResolutions(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		in    string
+		ex    []Resolution
+		exErr bool
+	}{
+		{
+			name: "Default",
+			in:   DefaultResolutions,
+			ex: []Resolution{
+				{Step: time.Second, Retention: 24 * time.Hour},
+				{Step: time.Minute, Retention: 90 * 24 * time.Hour},
+				{Step: 15 * time.Minute},
+			},
+		},
+		{name: "Unsorted", in: "1m:0, 1s:1h", ex: []Resolution{{time.Second, time.Hour}, {time.Minute, 0}}},
+		{name: "InvalidFormat", in: "1s", exErr: true},
+		{name: "SubSecondStep", in: "100ms:1h", exErr: true},
+		{name: "Duplicate", in: "1s:1h,1s:2h", exErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rs, err := ParseResolutions(tt.in)
+			if err != nil {
+				if tt.exErr {
+					return
+				}
+				t.Fatal(err)
+			}
+			if tt.exErr {
+				t.Fatal("expected error")
+			}
+
+			if len(rs) != len(tt.ex) {
+				t.Fatalf("expected %v, got %v", tt.ex, rs)
+			}
+			for i := range rs {
+				if rs[i] != tt.ex[i] {
+					t.Fatalf("expected %v, got %v", tt.ex, rs)
+				}
+			}
+		})
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	t.Parallel()
+
+	store := openTestStore(t, "1s:1h,1m:0")
+	start := time.Now().Truncate(time.Minute).Add(-10 * time.Minute)
+
+	// two minutes of summaries, two per second
+	for i := 0; i < 240; i++ {
+		err := store.Append("plant1", plant.Summary{
+			PV:           float32(i / 120 * 100),
+			TimestampEnd: start.Add(time.Duration(i) * 500 * time.Millisecond),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the last second isn't complete yet
+	raw, step, err := store.Query("plant1", start, start.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 119 || step != time.Second {
+		t.Fatalf("expected 119 raw points, got %v with step %v", len(raw), step)
+	}
+
+	downsampled, step, err := store.Query("plant1", start, start.Add(time.Hour), 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(downsampled) != 4 || step != 30*time.Second {
+		t.Fatalf("expected 4 points, got %v with step %v", len(downsampled), step)
+	}
+	if downsampled[0].PV != 0 || downsampled[2].PV != 100 {
+		t.Fatalf("unexpected points %v", downsampled)
+	}
+
+	// the minute resolution only contains the first, completed minute
+	minutes, _, err := store.Query("plant1", start, start.Add(time.Hour), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minutes) != 1 || !minutes[0].Time.Equal(start) || minutes[0].PV != 0 {
+		t.Fatalf("unexpected points %v", minutes)
+	}
+
+	err = store.Prune(start.Add(time.Hour + time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _, err = store.Query("plant1", start, start.Add(time.Hour), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 59 {
+		t.Fatalf("expected 59 raw points after pruning, got %v", len(raw))
+	}
+
+	// points older than the retention of raw points are read from the minute resolution
+	minutes, step, err = store.Query("plant1", start.Add(-2*time.Hour), start.Add(time.Hour), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minutes) != 1 || step != time.Minute {
+		t.Fatalf("expected 1 point with step of a minute, got %v with step %v", len(minutes), step)
+	}
+
+	unknown, _, err := store.Query("unknown", start, start.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unknown) != 0 {
+		t.Fatalf("expected no points, got %v", unknown)
+	}
+}
+
+func TestBoltStore_resolution(t *testing.T) {
+	t.Parallel()
+
+	store := openTestStore(t, DefaultResolutions)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		from   time.Time
+		step   time.Duration
+		exStep time.Duration
+	}{
+		{"Finest", now.Add(-time.Hour), 0, time.Second},
+		{"Coarsest", now.Add(-time.Hour), time.Hour, 15 * time.Minute},
+		{"BetweenSteps", now.Add(-time.Hour), 5 * time.Minute, time.Minute},
+		{"RawExpired", now.Add(-48 * time.Hour), time.Second, time.Minute},
+		{"MinutesExpired", now.Add(-100 * 24 * time.Hour), time.Second, 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if r := store.resolution(now, tt.from, tt.step); r.Step != tt.exStep {
+			t.Fatalf("%v: expected step %v, got %v", tt.name, tt.exStep, r.Step)
+		}
+	}
+}
+
+func TestDownsample_missingValues(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1608579360, 0)
+	points := downsample([]Point{
+		{Time: start, PV: 100, Grid: 50, SelfConsumption: 150, HasGrid: true},
+		{Time: start.Add(time.Second), PV: 200, Bat: -100, BatPercentage: 50, HasBattery: true},
+		{Time: start.Add(time.Minute), PV: 300},
+	}, time.Minute)
+
+	ex := []Point{
+		{
+			Time: start, PV: 150, Grid: 50, SelfConsumption: 150, HasGrid: true,
+			Bat: -100, BatPercentage: 50, HasBattery: true,
+		},
+		{Time: start.Add(time.Minute), PV: 300},
+	}
+	if len(points) != len(ex) {
+		t.Fatalf("expected %v, got %v", ex, points)
+	}
+	for i := range points {
+		if points[i] != ex[i] {
+			t.Fatalf("expected %v, got %v", ex, points)
+		}
+	}
+}
+
+func TestDecodePoint(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		in   []byte
+		ex   encodedPoint
+	}{
+		{
+			name: "Legacy",
+			in:   []byte{0x42, 0xC8, 0, 0, 0x43, 0x48, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			ex:   encodedPoint{Grid: 100, PV: 200, Flags: ^uint8(0)},
+		},
+		{
+			name: "WithoutBattery",
+			in:   []byte{0x42, 0xC8, 0, 0, 0x43, 0x48, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, flagGrid},
+			ex:   encodedPoint{Grid: 100, PV: 200, Flags: flagGrid},
+		},
+	}
+
+	for _, tt := range tests {
+		ep, err := decodePoint(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ep != tt.ex {
+			t.Fatalf("%v: expected %+v, got %+v", tt.name, tt.ex, ep)
+		}
+	}
+}
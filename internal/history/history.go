@@ -0,0 +1,215 @@
+// Package history provides persistence of plant summaries as downsampled time series.
+package history
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pruneInterval is the interval in which points exceeding the retention of their resolution are removed.
+const pruneInterval = time.Minute
+
+// DefaultResolutions keeps raw data for a day, minutely data for 90 days and 15 minute data forever.
+const DefaultResolutions = "1s:24h,1m:2160h,15m:0"
+
+// Resolution describes a downsampled series of summaries.
+type Resolution struct {
+	// Step is the duration of which summaries are averaged into a single point.
+	Step time.Duration
+	// Retention is the duration after which points are removed. Points are kept forever if it is 0.
+	Retention time.Duration
+}
+
+// Point is the average of all summaries during a step.
+type Point struct {
+	Time            time.Time
+	Grid            float32
+	PV, Bat         float32
+	SelfConsumption float32
+	BatPercentage   float32
+	// HasBattery is false if none of the summaries had a battery, Bat and BatPercentage are 0 then.
+	HasBattery bool
+	// HasGrid is false if none of the summaries had a grid meter, Grid and SelfConsumption are 0 then.
+	HasGrid bool
+}
+
+// Store persists summaries of plants.
+type Store interface {
+	// Append adds a summary of a plant to the store.
+	Append(name string, s plant.Summary) error
+	// Query returns the points of a plant in the time range [from, to], using the given step between points, and the
+	// step of the returned points, which differs from the given step if no resolution fits it.
+	//
+	// If step is 0, the finest available resolution is used.
+	Query(name string, from, to time.Time, step time.Duration) ([]Point, time.Duration, error)
+	// Prune removes all points which exceed the retention of their resolution.
+	Prune(now time.Time) error
+	Close() error
+}
+
+// ParseResolutions parses resolutions in the form of "<step>:<retention>,...", e.g. "1s:24h,1m:2160h,15m:0".
+func ParseResolutions(s string) ([]Resolution, error) {
+	var resolutions []Resolution
+
+	for _, v := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(v), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid resolution %v, expected <step>:<retention>", v)
+		}
+
+		step, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid step")
+		}
+		if step < time.Second {
+			return nil, fmt.Errorf("step of resolution %v must be at least one second", v)
+		}
+
+		retention, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid retention")
+		}
+
+		resolutions = append(resolutions, Resolution{Step: step, Retention: retention})
+	}
+
+	sort.Slice(resolutions, func(i, j int) bool {
+		return resolutions[i].Step < resolutions[j].Step
+	})
+
+	for i := 1; i < len(resolutions); i++ {
+		if resolutions[i].Step == resolutions[i-1].Step {
+			return nil, fmt.Errorf("duplicate resolution step %v", resolutions[i].Step)
+		}
+	}
+
+	return resolutions, nil
+}
+
+// Record appends all summaries of the plants to the store and prunes the store until the context is done.
+func Record(ctx context.Context, store Store, plants map[string]plant.Subscriber) {
+	for k, v := range plants {
+		go func(name string, p plant.Subscriber) {
+			summaries, unsubscribe := p.Subscribe()
+			defer unsubscribe()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case s, ok := <-summaries:
+					if !ok {
+						return
+					}
+					err := store.Append(name, s)
+					if err != nil {
+						log.Println(errors.Wrap(err, fmt.Sprintf("error storing summary of plant %v", name)))
+					}
+				}
+			}
+		}(k, v)
+	}
+
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				err := store.Prune(now)
+				if err != nil {
+					log.Println(errors.Wrap(err, "error pruning history"))
+				}
+			}
+		}
+	}()
+}
+
+// accumulator sums up summaries during a step.
+type accumulator struct {
+	window time.Time
+	count  int
+	// batCount and gridCount are the number of summaries with a battery and a grid meter, their values are averaged
+	// over those only.
+	batCount, gridCount int
+	sum                 Point
+}
+
+func (a *accumulator) add(p Point) {
+	a.count++
+	a.sum.PV += p.PV
+	if p.HasGrid {
+		a.gridCount++
+		a.sum.Grid += p.Grid
+		a.sum.SelfConsumption += p.SelfConsumption
+	}
+	if p.HasBattery {
+		a.batCount++
+		a.sum.Bat += p.Bat
+		a.sum.BatPercentage += p.BatPercentage
+	}
+}
+
+func (a *accumulator) average() Point {
+	p := Point{
+		Time: a.window,
+		PV:   a.sum.PV / float32(a.count),
+	}
+	if a.gridCount > 0 {
+		p.HasGrid = true
+		p.Grid = a.sum.Grid / float32(a.gridCount)
+		p.SelfConsumption = a.sum.SelfConsumption / float32(a.gridCount)
+	}
+	if a.batCount > 0 {
+		p.HasBattery = true
+		p.Bat = a.sum.Bat / float32(a.batCount)
+		p.BatPercentage = a.sum.BatPercentage / float32(a.batCount)
+	}
+	return p
+}
+
+// downsample averages the points into the given step.
+func downsample(points []Point, step time.Duration) []Point {
+	var (
+		res []Point
+		acc accumulator
+	)
+
+	for _, p := range points {
+		window := p.Time.Truncate(step)
+		if acc.count > 0 && !window.Equal(acc.window) {
+			res = append(res, acc.average())
+			acc = accumulator{}
+		}
+		acc.window = window
+		acc.add(p)
+	}
+
+	if acc.count > 0 {
+		res = append(res, acc.average())
+	}
+
+	return res
+}
+
+func pointFromSummary(s plant.Summary) Point {
+	return Point{
+		Time:            s.TimestampEnd,
+		Grid:            s.Grid,
+		PV:              s.PV,
+		Bat:             s.Bat,
+		SelfConsumption: s.SelfConsumption,
+		BatPercentage:   float32(s.BatPercentage),
+		HasBattery:      s.HasBattery,
+		HasGrid:         s.HasGrid,
+	}
+}
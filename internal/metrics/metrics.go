@@ -0,0 +1,151 @@
+// Package metrics provides prometheus metrics of plants.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "energy"
+
+// Metrics holds the prometheus collectors for all plants.
+type Metrics struct {
+	grid            *prometheus.GaugeVec
+	pv              *prometheus.GaugeVec
+	bat             *prometheus.GaugeVec
+	selfConsumption *prometheus.GaugeVec
+	batSoC          *prometheus.GaugeVec
+	gridImport      *prometheus.GaugeVec
+	gridExport      *prometheus.GaugeVec
+	phasePower      *prometheus.GaugeVec
+	phaseVoltage    *prometheus.GaugeVec
+	phaseCurrent    *prometheus.GaugeVec
+	devicePower     *prometheus.GaugeVec
+	deviceSoC       *prometheus.GaugeVec
+	fetchDuration   *prometheus.HistogramVec
+	fetchErrors     *prometheus.CounterVec
+}
+
+// New creates the plant metrics and registers them using the given registerer.
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	plantGauge := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"plant"})
+	}
+
+	phaseGauge := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"plant", "phase"})
+	}
+
+	deviceGauge := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"plant", "device", "type"})
+	}
+
+	m := &Metrics{
+		grid:            plantGauge("grid_power_watts", "Power drawn from the grid, negative if power is fed into the grid."),
+		pv:              plantGauge("pv_power_watts", "Power produced by all PV inverters."),
+		bat:             plantGauge("battery_power_watts", "Power discharged from the battery, negative if the battery is charging."),
+		selfConsumption: plantGauge("self_consumption_watts", "Power consumed by the plant."),
+		batSoC:          plantGauge("battery_soc_percent", "State of charge of the battery."),
+		gridImport:      plantGauge("grid_import_watthours", "Energy drawn from the grid, read from the grid meter."),
+		gridExport:      plantGauge("grid_export_watthours", "Energy fed into the grid, read from the grid meter."),
+		phasePower:      phaseGauge("grid_phase_power_watts", "Power drawn from the grid per phase, negative if power is fed into the grid."),
+		phaseVoltage:    phaseGauge("grid_phase_voltage_volts", "Voltage per phase."),
+		phaseCurrent:    phaseGauge("grid_phase_current_amperes", "Current per phase."),
+		devicePower:     deviceGauge("device_power_watts", "Power of a single inverter."),
+		deviceSoC:       deviceGauge("device_soc_percent", "State of charge of a single battery inverter."),
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "fetch_duration_seconds",
+			Help:      "Duration of fetching the devices of a plant.",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"plant"}),
+		fetchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fetch_errors_total",
+			Help:      "Number of failed fetches by cause.",
+		}, []string{"plant", "cause"}),
+	}
+
+	collectors := []prometheus.Collector{
+		m.grid, m.pv, m.bat, m.selfConsumption, m.batSoC, m.gridImport, m.gridExport,
+		m.phasePower, m.phaseVoltage, m.phaseCurrent, m.devicePower, m.deviceSoC, m.fetchDuration, m.fetchErrors,
+	}
+	for _, c := range collectors {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Instrument wraps the fetcher of a plant, recording every fetched summary and error.
+func (m *Metrics) Instrument(name string, f plant.Fetcher) plant.Fetcher {
+	return &instrumentedFetcher{
+		name:    name,
+		fetcher: f,
+		metrics: m,
+	}
+}
+
+type instrumentedFetcher struct {
+	name    string
+	fetcher plant.Fetcher
+	metrics *Metrics
+}
+
+func (i *instrumentedFetcher) FetchSummary(ctx context.Context) (plant.Summary, error) {
+	s, err := i.fetcher.FetchSummary(ctx)
+	if err != nil {
+		i.metrics.fetchErrors.WithLabelValues(i.name, plant.ErrorClass(err)).Inc()
+		return s, err
+	}
+
+	m := i.metrics
+	m.pv.WithLabelValues(i.name).Set(float64(s.PV))
+	if s.HasGrid {
+		m.grid.WithLabelValues(i.name).Set(float64(s.Grid))
+		m.selfConsumption.WithLabelValues(i.name).Set(float64(s.SelfConsumption))
+	}
+	if s.HasBattery {
+		m.bat.WithLabelValues(i.name).Set(float64(s.Bat))
+		m.batSoC.WithLabelValues(i.name).Set(float64(s.BatPercentage))
+	}
+	if s.GridImportEnergy != 0 || s.GridExportEnergy != 0 {
+		m.gridImport.WithLabelValues(i.name).Set(s.GridImportEnergy)
+		m.gridExport.WithLabelValues(i.name).Set(s.GridExportEnergy)
+	}
+	for j, p := range s.GridPhases {
+		phase := fmt.Sprintf("L%d", j+1)
+		m.phasePower.WithLabelValues(i.name, phase).Set(float64(p.Power))
+		m.phaseVoltage.WithLabelValues(i.name, phase).Set(float64(p.Voltage))
+		m.phaseCurrent.WithLabelValues(i.name, phase).Set(float64(p.Current))
+	}
+	for _, d := range s.Devices {
+		if d.Unused {
+			continue
+		}
+		m.devicePower.WithLabelValues(i.name, d.Address, d.Type).Set(float64(d.Power))
+		if d.Type == plant.DeviceTypeBattery {
+			m.deviceSoC.WithLabelValues(i.name, d.Address, d.Type).Set(float64(d.SoC))
+		}
+	}
+	m.fetchDuration.WithLabelValues(i.name).Observe(s.TimestampEnd.Sub(s.TimestampStart).Seconds())
+
+	return s, nil
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+type dummyFetcher struct {
+	summary plant.Summary
+	err     error
+}
+
+func (d *dummyFetcher) FetchSummary(ctx context.Context) (plant.Summary, error) {
+	return d.summary, d.err
+}
+
+func TestMetrics_Instrument(t *testing.T) {
+	t.Parallel()
+
+	reg := prometheus.NewRegistry()
+	m, err := New(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	f := &dummyFetcher{summary: plant.Summary{
+		Grid:            -50,
+		PV:              300,
+		Bat:             -100,
+		SelfConsumption: 150,
+		BatPercentage:   60,
+		HasBattery:      true,
+		HasGrid:         true,
+		TimestampStart:  start,
+		TimestampEnd:    start.Add(200 * time.Millisecond),
+		Devices: []plant.DeviceSummary{
+			{Address: "192.168.1.1:502", Type: plant.DeviceTypePV, Power: 300},
+		},
+	}}
+	instrumented := m.Instrument("plant1", f)
+
+	_, err = instrumented.FetchSummary(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gauges := map[*prometheus.GaugeVec]float64{
+		m.grid:            -50,
+		m.pv:              300,
+		m.bat:             -100,
+		m.selfConsumption: 150,
+		m.batSoC:          60,
+	}
+	for g, ex := range gauges {
+		if v := testutil.ToFloat64(g.WithLabelValues("plant1")); v != ex {
+			t.Fatalf("expected gauge value %v, got %v", ex, v)
+		}
+	}
+
+	if v := testutil.ToFloat64(m.devicePower.WithLabelValues("plant1", "192.168.1.1:502", plant.DeviceTypePV)); v != 300 {
+		t.Fatalf("expected device power 300, got %v", v)
+	}
+
+	f.err = &plant.FetchError{Err: plant.ErrNoData}
+	_, err = instrumented.FetchSummary(context.Background())
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	f.err = fmt.Errorf("dummy error")
+	_, _ = instrumented.FetchSummary(context.Background())
+
+	if v := testutil.ToFloat64(m.fetchErrors.WithLabelValues("plant1", plant.ErrorClassNoData)); v != 1 {
+		t.Fatalf("expected one no data error, got %v", v)
+	}
+	if v := testutil.ToFloat64(m.fetchErrors.WithLabelValues("plant1", plant.ErrorClassUnknown)); v != 1 {
+		t.Fatalf("expected one unknown error, got %v", v)
+	}
+
+	if n := testutil.CollectAndCount(m.fetchDuration); n != 1 {
+		t.Fatalf("expected one histogram, got %v", n)
+	}
+}
@@ -0,0 +1,174 @@
+// Package modbus provides a modbus TCP client for SunSpec devices.
+//
+// Unlike the client of go-energy, it doesn't reconnect on its own but returns errors, so the caller decides when to
+// reconnect.
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/goburrow/modbus"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// Client reads and writes holding registers of a modbus TCP device.
+type Client struct {
+	handler *modbus.TCPClientHandler
+	client  modbus.Client
+}
+
+// Dial connects to the device at the address, using the slave id for all requests.
+//
+// timeout is the timeout of connecting and of each request.
+func Dial(addr string, slaveID byte, timeout time.Duration) (*Client, error) {
+	handler := modbus.NewTCPClientHandler(addr)
+	handler.SlaveId = slaveID
+	handler.Timeout = timeout
+
+	err := handler.Connect()
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to modbus")
+	}
+
+	return &Client{handler: handler, client: modbus.NewClient(handler)}, nil
+}
+
+// Device is a SunSpec device connected via modbus TCP.
+type Device struct {
+	*sunspec.ModelReader
+	Client *Client
+}
+
+// DialSunSpec connects to the SunSpec device at the address, see Dial.
+func DialSunSpec(addr string, slaveID byte, timeout time.Duration) (*Device, error) {
+	c, err := Dial(addr, slaveID, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Device{
+		ModelReader: &sunspec.ModelReader{
+			Reader:    c,
+			Converter: &sunspec.CachedModelConverter{ModelScanner: &sunspec.AddressModelScanner{Reader: c}},
+		},
+		Client: c,
+	}, nil
+}
+
+// WritePoint writes the values to the registers starting at the point of the model.
+func (d *Device) WritePoint(model, point uint16, values ...uint16) error {
+	address, err := d.Converter.GetAddress(model)
+	if err != nil {
+		return err
+	}
+	return d.Client.WriteRegisters(address+point, values...)
+}
+
+// Close closes the connection to the device.
+func (d *Device) Close() error {
+	return d.Client.Close()
+}
+
+func (c *Client) Close() error {
+	return c.handler.Close()
+}
+
+// ReadInto reads the holding registers starting at the address into v, which must be a fixed size value.
+func (c *Client) ReadInto(address uint16, v interface{}) error {
+	size := binary.Size(v)
+	if size <= 0 {
+		return errors.Errorf("can't read into %T", v)
+	}
+
+	// registers are 2 bytes wide
+	registers, err := c.client.ReadHoldingRegisters(address, uint16((size+1)/2))
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(bytes.NewReader(registers), binary.BigEndian, v)
+}
+
+// WriteRegisters writes the values to the holding registers starting at the address.
+func (c *Client) WriteRegisters(address uint16, values ...uint16) error {
+	b := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(b[2*i:], v)
+	}
+
+	_, err := c.client.WriteMultipleRegisters(address, uint16(len(values)), b)
+	return err
+}
+
+// WriteCoil switches the coil at the address on or off.
+func (c *Client) WriteCoil(address uint16, on bool) error {
+	var value uint16
+	if on {
+		value = 0xFF00
+	}
+
+	_, err := c.client.WriteSingleCoil(address, value)
+	return err
+}
+
+func (c *Client) ReadUint16(address uint16) (uint16, error) {
+	var v uint16
+	err := c.ReadInto(address, &v)
+	return v, err
+}
+
+func (c *Client) ReadUint32(address uint16) (uint32, error) {
+	var v uint32
+	err := c.ReadInto(address, &v)
+	return v, err
+}
+
+func (c *Client) ReadUint64(address uint16) (uint64, error) {
+	var v uint64
+	err := c.ReadInto(address, &v)
+	return v, err
+}
+
+func (c *Client) ReadInt16(address uint16) (int16, error) {
+	var v int16
+	err := c.ReadInto(address, &v)
+	return v, err
+}
+
+func (c *Client) ReadInt32(address uint16) (int32, error) {
+	var v int32
+	err := c.ReadInto(address, &v)
+	return v, err
+}
+
+func (c *Client) ReadInt64(address uint16) (int64, error) {
+	var v int64
+	err := c.ReadInto(address, &v)
+	return v, err
+}
+
+func (c *Client) ReadFloat32(address uint16) (float32, error) {
+	var v float32
+	err := c.ReadInto(address, &v)
+	return v, err
+}
+
+func (c *Client) ReadFloat64(address uint16) (float64, error) {
+	var v float64
+	err := c.ReadInto(address, &v)
+	return v, err
+}
+
+// ReadString reads a string of the given number of registers, trailing null bytes are removed.
+func (c *Client) ReadString(address, words uint16) (string, error) {
+	b := make([]byte, 2*words)
+	err := c.ReadInto(address, b)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\x00 "), nil
+}
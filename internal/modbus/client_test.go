@@ -0,0 +1,194 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dummyServer is a modbus TCP server serving holding registers and coils.
+type dummyServer struct {
+	l net.Listener
+
+	m         sync.Mutex
+	registers map[uint16]uint16
+	coils     map[uint16]bool
+}
+
+func newDummyServer(t *testing.T, registers map[uint16]uint16) *dummyServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &dummyServer{l: l, registers: registers, coils: map[uint16]bool{}}
+	go s.serve()
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return s
+}
+
+func (s *dummyServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *dummyServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		address := binary.BigEndian.Uint16(pdu[1:])
+		quantity := binary.BigEndian.Uint16(pdu[3:])
+
+		var res []byte
+		s.m.Lock()
+		switch pdu[0] {
+		case 0x03:
+			res = []byte{pdu[0], byte(2 * quantity)}
+			for i := uint16(0); i < quantity; i++ {
+				res = append(res, 0, 0)
+				binary.BigEndian.PutUint16(res[len(res)-2:], s.registers[address+i])
+			}
+		case 0x05:
+			// the value of the coil takes the place of the quantity
+			s.coils[address] = quantity == 0xFF00
+			res = pdu[:5]
+		case 0x10:
+			for i := uint16(0); i < quantity; i++ {
+				s.registers[address+i] = binary.BigEndian.Uint16(pdu[6+2*i:])
+			}
+			res = pdu[:5]
+		}
+		s.m.Unlock()
+
+		binary.BigEndian.PutUint16(header[4:], uint16(len(res)+1))
+		if _, err := conn.Write(append(header, res...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestDialSunSpec(t *testing.T) {
+	t.Parallel()
+
+	registers := map[uint16]uint16{
+		// SunSpec identifier
+		40000: 0x5375,
+		40001: 0x6e53,
+		// common model
+		40002: 1,
+		40003: 66,
+		40004: 'S'<<8 | 'M',
+		40005: 'A' << 8,
+		40068: 3,
+		// end of models
+		40070: 0xFFFF,
+	}
+	s := newDummyServer(t, registers)
+
+	d, err := DialSunSpec(s.l.Addr().String(), 126, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	addr, err := d.GetAnyPoint(sunspec.PointDeviceAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != 3 {
+		t.Fatalf("expected device address 3, got %v", addr)
+	}
+
+	mn, err := d.Client.ReadString(40004, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mn != "SMA" {
+		t.Fatalf("expected manufacturer SMA, got %q", mn)
+	}
+
+	// strings of models are read with the client of the device
+	mn, err = d.ReadString(1, 2, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mn != "SMA" {
+		t.Fatalf("expected manufacturer SMA of common model, got %q", mn)
+	}
+
+	err = d.Client.WriteRegisters(40100, 1, 0xFFFF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := d.Client.ReadInt32(40100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 0x1FFFF {
+		t.Fatalf("expected written value, got %x", v)
+	}
+}
+
+func TestClient_WriteCoil(t *testing.T) {
+	t.Parallel()
+
+	s := newDummyServer(t, map[uint16]uint16{})
+
+	c, err := Dial(s.l.Addr().String(), 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, on := range []bool{true, false} {
+		err = c.WriteCoil(3, on)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.m.Lock()
+		coil := s.coils[3]
+		s.m.Unlock()
+		if coil != on {
+			t.Fatalf("expected coil to be %v", on)
+		}
+	}
+}
+
+func TestDial_refused(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	_, err = Dial(addr, 126, time.Second)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
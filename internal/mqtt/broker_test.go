@@ -0,0 +1,253 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// brokerMessage is a message published to the testBroker.
+type brokerMessage struct {
+	topic    string
+	payload  string
+	qos      byte
+	retained bool
+}
+
+// testBroker is an in-process MQTT 3.1.1 broker recording all published messages.
+// It doesn't support subscriptions, tests inspect the recorded messages instead.
+type testBroker struct {
+	l net.Listener
+
+	m sync.Mutex
+	// conns contains the open connections with their last will, nil if they have none.
+	conns     map[net.Conn]*brokerMessage
+	retained  map[string]brokerMessage
+	published []brokerMessage
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &testBroker{
+		l:        l,
+		conns:    map[net.Conn]*brokerMessage{},
+		retained: map[string]brokerMessage{},
+	}
+	go b.serve()
+	t.Cleanup(func() {
+		_ = l.Close()
+		b.kick()
+	})
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.l.Addr().String()
+}
+
+func (b *testBroker) serve() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *testBroker) handle(conn net.Conn) {
+	clean := false
+	defer func() {
+		b.m.Lock()
+		defer b.m.Unlock()
+		b.closeConn(conn, !clean)
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		var res []byte
+		switch header >> 4 {
+		case 1: // CONNECT
+			p := &packetReader{b: body}
+			p.string() // protocol name
+			p.next(1)  // protocol level
+			flags := p.next(1)[0]
+			p.next(2)  // keep alive
+			p.string() // client id
+
+			var will *brokerMessage
+			if flags&0x04 != 0 {
+				will = &brokerMessage{
+					topic:    p.string(),
+					payload:  p.string(),
+					qos:      flags >> 3 & 0x03,
+					retained: flags&0x20 != 0,
+				}
+			}
+			b.m.Lock()
+			b.conns[conn] = will
+			b.m.Unlock()
+			res = []byte{0x20, 2, 0, 0}
+		case 3: // PUBLISH
+			qos := header >> 1 & 0x03
+			p := &packetReader{b: body}
+			m := brokerMessage{topic: p.string(), qos: qos, retained: header&0x01 != 0}
+			var id []byte
+			if qos > 0 {
+				id = p.next(2)
+			}
+			m.payload = string(p.b)
+
+			b.m.Lock()
+			b.publish(m)
+			b.m.Unlock()
+
+			switch qos {
+			case 1:
+				res = append([]byte{0x40, 2}, id...)
+			case 2:
+				res = append([]byte{0x50, 2}, id...)
+			}
+		case 6: // PUBREL
+			res = append([]byte{0x70, 2}, body[:2]...)
+		case 12: // PINGREQ
+			res = []byte{0xD0, 0}
+		case 14: // DISCONNECT
+			clean = true
+			return
+		}
+
+		if res != nil {
+			if _, err := conn.Write(res); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// publish records the message, b.m must be held.
+func (b *testBroker) publish(m brokerMessage) {
+	b.published = append(b.published, m)
+	if !m.retained {
+		return
+	}
+	if m.payload == "" {
+		delete(b.retained, m.topic)
+		return
+	}
+	b.retained[m.topic] = m
+}
+
+// closeConn closes the connection, publishing its last will if lost. b.m must be held.
+func (b *testBroker) closeConn(conn net.Conn, lost bool) {
+	will, ok := b.conns[conn]
+	_ = conn.Close()
+	if !ok {
+		return
+	}
+
+	delete(b.conns, conn)
+	if lost && will != nil {
+		b.publish(*will)
+	}
+}
+
+// kick closes all connections as if they were lost.
+func (b *testBroker) kick() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for conn := range b.conns {
+		b.closeConn(conn, true)
+	}
+}
+
+// payloads returns the payloads of all messages published to the topic.
+func (b *testBroker) payloads(topic string) []string {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	var ps []string
+	for _, m := range b.published {
+		if m.topic == topic {
+			ps = append(ps, m.payload)
+		}
+	}
+	return ps
+}
+
+// retainedMessage returns the retained message of the topic.
+func (b *testBroker) retainedMessage(topic string) (brokerMessage, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	m, ok := b.retained[topic]
+	return m, ok
+}
+
+// waitFor fails the test if f doesn't return true within a second.
+func waitFor(t *testing.T, msg string, f func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// the remaining length is encoded in up to 4 bytes of 7 bits each
+	length, shift := 0, uint(0)
+	for i := 0; i < 4; i++ {
+		v, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(v&0x7F) << shift
+		if v&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// packetReader reads the fields of a packet, malformed packets panic.
+type packetReader struct {
+	b []byte
+}
+
+func (p *packetReader) next(n int) []byte {
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *packetReader) string() string {
+	return string(p.next(int(binary.BigEndian.Uint16(p.next(2)))))
+}
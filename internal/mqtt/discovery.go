@@ -0,0 +1,76 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"strings"
+)
+
+// discoveryConfig is the config of a Home Assistant MQTT sensor.
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	Unit              string          `json:"unit_of_measurement"`
+	DeviceClass       string          `json:"device_class"`
+	StateClass        string          `json:"state_class"`
+	AvailabilityTopic string          `json:"availability_topic,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+// discoveryDevice groups sensors in Home Assistant.
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+// discovery returns the Home Assistant discovery configs of the sensors of the plant.
+//
+// Sensors of the plant belong to a device named like the plant, sensors of devices of the plant to a device connected
+// via the plant, described by the identity of the device if known.
+func (p *Publisher) discovery(name string, ss []sensor, identities map[string]plant.Identity) ([]message, error) {
+	node := topicID(p.Prefix + "_" + name)
+	plantDevice := discoveryDevice{
+		Identifiers: []string{node},
+		Name:        name,
+		Model:       "Plant",
+	}
+
+	ms := make([]message, 0, len(ss))
+	for _, s := range ss {
+		object := topicID(strings.ReplaceAll(s.path, "/", "_"))
+		c := discoveryConfig{
+			Name:              s.name,
+			UniqueID:          node + "_" + object,
+			StateTopic:        p.stateTopic(name, s.path),
+			Unit:              s.kind.unit,
+			DeviceClass:       s.kind.deviceClass,
+			StateClass:        s.kind.stateClass,
+			AvailabilityTopic: p.Client.opts.StatusTopic,
+			Device:            plantDevice,
+		}
+		if s.device != "" {
+			id := identities[s.device]
+			c.Device = discoveryDevice{
+				Identifiers:  []string{node + "_" + topicID(s.device)},
+				Name:         fmt.Sprintf("%v %v", name, s.device),
+				Manufacturer: id.Manufacturer,
+				Model:        id.Model,
+				SWVersion:    id.Version,
+				ViaDevice:    node,
+			}
+		}
+
+		b, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, message{fmt.Sprintf("%v/sensor/%v/%v/config", p.DiscoveryPrefix, node, object), b})
+	}
+	return ms, nil
+}
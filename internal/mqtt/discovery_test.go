@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"github.com/orlopau/go-sma-api/internal/energy"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"reflect"
+	"testing"
+)
+
+func TestPublisher_discovery(t *testing.T) {
+	t.Parallel()
+
+	p := &Publisher{
+		Client:          &Client{opts: Options{StatusTopic: "energy/status"}},
+		Prefix:          "energy",
+		DiscoveryPrefix: "homeassistant",
+	}
+	s := plant.Summary{
+		Devices: []plant.DeviceSummary{{Address: "192.168.188.34:502", Type: plant.DeviceTypeBattery}},
+	}
+	identities := map[string]plant.Identity{
+		"192.168.188.34:502": {Manufacturer: "SMA", Model: "SBS3.7-10", Version: "3.10.10.R"},
+	}
+
+	ms, err := p.discovery("plant 1", sensors(s, &energy.Totals{}), identities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configs := make(map[string]discoveryConfig, len(ms))
+	for _, m := range ms {
+		var c discoveryConfig
+		err := json.Unmarshal(m.payload, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs[m.topic] = c
+	}
+
+	plantDevice := discoveryDevice{Identifiers: []string{"energy_plant_1"}, Name: "plant 1", Model: "Plant"}
+	tests := []struct {
+		topic string
+		ex    discoveryConfig
+	}{
+		{
+			topic: "homeassistant/sensor/energy_plant_1/pv/config",
+			ex: discoveryConfig{
+				Name:              "PV power",
+				UniqueID:          "energy_plant_1_pv",
+				StateTopic:        "energy/plant_1/pv",
+				Unit:              "W",
+				DeviceClass:       "power",
+				StateClass:        "measurement",
+				AvailabilityTopic: "energy/status",
+				Device:            plantDevice,
+			},
+		},
+		{
+			topic: "homeassistant/sensor/energy_plant_1/energy_pv/config",
+			ex: discoveryConfig{
+				Name:              "PV energy today",
+				UniqueID:          "energy_plant_1_energy_pv",
+				StateTopic:        "energy/plant_1/energy/pv",
+				Unit:              "Wh",
+				DeviceClass:       "energy",
+				StateClass:        "total_increasing",
+				AvailabilityTopic: "energy/status",
+				Device:            plantDevice,
+			},
+		},
+		{
+			topic: "homeassistant/sensor/energy_plant_1/devices_192_168_188_34_502_soc/config",
+			ex: discoveryConfig{
+				Name:              "SoC",
+				UniqueID:          "energy_plant_1_devices_192_168_188_34_502_soc",
+				StateTopic:        "energy/plant_1/devices/192_168_188_34_502/soc",
+				Unit:              "%",
+				DeviceClass:       "battery",
+				StateClass:        "measurement",
+				AvailabilityTopic: "energy/status",
+				Device: discoveryDevice{
+					Identifiers:  []string{"energy_plant_1_192_168_188_34_502"},
+					Name:         "plant 1 192.168.188.34:502",
+					Manufacturer: "SMA",
+					Model:        "SBS3.7-10",
+					SWVersion:    "3.10.10.R",
+					ViaDevice:    "energy_plant_1",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if c, ok := configs[tt.topic]; !ok || !reflect.DeepEqual(c, tt.ex) {
+			t.Fatalf("expected config %+v at %v, got %+v", tt.ex, tt.topic, c)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package mqtt publishes to an MQTT broker, e.g. the summaries of plants.
+package mqtt
+
+import (
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Payloads of the status topic.
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// defaultMaxReconnectInterval bounds the backoff of reconnects, if not configured.
+const defaultMaxReconnectInterval = time.Minute
+
+// ErrNotConnected is returned for messages published while the client is not connected.
+var ErrNotConnected = errors.New("not connected to mqtt broker")
+
+// Options configures the connection to a broker.
+type Options struct {
+	// Broker is the URL of the broker, e.g. tcp://localhost:1883.
+	Broker             string
+	ClientID           string
+	Username, Password string
+	// Timeout is the timeout of connecting and of each publish.
+	Timeout time.Duration
+	// StatusTopic receives a retained StatusOnline on each connect and StatusOffline when the client is closed or,
+	// as last will, when the connection is lost. No status is published if it is empty.
+	StatusTopic string
+	// QoS is the qos of status messages.
+	QoS byte
+	// MaxReconnectInterval bounds the backoff of reconnects, 0 for the default of a minute.
+	MaxReconnectInterval time.Duration
+}
+
+// Client publishes messages to an MQTT broker.
+//
+// The client connects in the background and reconnects whenever the connection is lost.
+type Client struct {
+	client paho.Client
+	opts   Options
+	// connects counts the connections to the broker, it must be accessed atomically.
+	connects uint32
+}
+
+// Connect returns a client connecting to the broker in the background.
+func Connect(o Options) *Client {
+	if o.MaxReconnectInterval == 0 {
+		o.MaxReconnectInterval = defaultMaxReconnectInterval
+	}
+	client := &Client{opts: o}
+
+	opts := paho.NewClientOptions().
+		AddBroker(o.Broker).
+		SetClientID(o.ClientID).
+		SetUsername(o.Username).
+		SetPassword(o.Password).
+		SetConnectTimeout(o.Timeout).
+		SetWriteTimeout(o.Timeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(o.MaxReconnectInterval).
+		SetMaxReconnectInterval(o.MaxReconnectInterval).
+		SetOnConnectHandler(func(c paho.Client) {
+			log.Printf("connected to %v", o.Broker)
+			atomic.AddUint32(&client.connects, 1)
+			if o.StatusTopic == "" {
+				return
+			}
+			err := wait(c.Publish(o.StatusTopic, o.QoS, true, StatusOnline), o.Timeout)
+			if err != nil {
+				log.Println(errors.Wrap(err, "error publishing status"))
+			}
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Printf("lost connection to %v: %v", o.Broker, err)
+		})
+	if o.StatusTopic != "" {
+		opts.SetWill(o.StatusTopic, StatusOffline, o.QoS, true)
+	}
+
+	client.client = paho.NewClient(opts)
+	// completes once connected, errors are retried in the background
+	client.client.Connect()
+
+	return client
+}
+
+// Connects returns the number of connections to the broker so far, which changes on each reconnect.
+func (c *Client) Connects() uint32 {
+	return atomic.LoadUint32(&c.connects)
+}
+
+// Publish publishes the payload to the topic and waits until it was delivered as required by the qos.
+//
+// Messages aren't queued while the client is disconnected, ErrNotConnected is returned instead.
+func (c *Client) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	if !c.client.IsConnectionOpen() {
+		return ErrNotConnected
+	}
+	return wait(c.client.Publish(topic, qos, retained, payload), c.opts.Timeout)
+}
+
+// Close publishes the offline status and disconnects from the broker.
+func (c *Client) Close() {
+	if c.opts.StatusTopic != "" {
+		err := c.Publish(c.opts.StatusTopic, c.opts.QoS, true, []byte(StatusOffline))
+		if err != nil && err != ErrNotConnected {
+			log.Println(errors.Wrap(err, "error publishing status"))
+		}
+	}
+	c.client.Disconnect(uint(c.opts.Timeout.Milliseconds()))
+}
+
+func wait(t paho.Token, timeout time.Duration) error {
+	if !t.WaitTimeout(timeout) {
+		return errors.New("timeout")
+	}
+	return t.Error()
+}
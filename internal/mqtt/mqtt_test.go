@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testOptions(b *testBroker) Options {
+	return Options{
+		Broker:               b.url(),
+		ClientID:             "test",
+		Timeout:              time.Second,
+		StatusTopic:          "energy/status",
+		QoS:                  1,
+		MaxReconnectInterval: 100 * time.Millisecond,
+	}
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+
+	b := newTestBroker(t)
+	c := Connect(testOptions(b))
+
+	waitFor(t, "expected online status", func() bool {
+		m, ok := b.retainedMessage("energy/status")
+		return ok && m.payload == StatusOnline && m.qos == 1
+	})
+
+	err := c.Publish("energy/test", 2, false, []byte("42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := b.payloads("energy/test"); !reflect.DeepEqual(p, []string{"42"}) {
+		t.Fatalf("expected published message, got %v", p)
+	}
+
+	c.Close()
+	if p := b.payloads("energy/status"); !reflect.DeepEqual(p, []string{StatusOnline, StatusOffline}) {
+		t.Fatalf("expected offline status on close, got %v", p)
+	}
+	if err := c.Publish("energy/test", 0, false, nil); err != ErrNotConnected {
+		t.Fatalf("expected %v after close, got %v", ErrNotConnected, err)
+	}
+}
+
+func TestClient_reconnect(t *testing.T) {
+	t.Parallel()
+
+	b := newTestBroker(t)
+	c := Connect(testOptions(b))
+	defer c.Close()
+
+	waitFor(t, "expected online status", func() bool {
+		return len(b.payloads("energy/status")) == 1
+	})
+
+	b.kick()
+
+	// the last will is published when the connection is lost, the status is published again after reconnecting
+	waitFor(t, "expected reconnect", func() bool {
+		return reflect.DeepEqual(b.payloads("energy/status"), []string{StatusOnline, StatusOffline, StatusOnline})
+	})
+	m, _ := b.retainedMessage("energy/status")
+	if m.payload != StatusOnline {
+		t.Fatalf("expected retained online status, got %v", m.payload)
+	}
+
+	err := c.Publish("energy/test", 1, false, []byte("42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnect_offline(t *testing.T) {
+	t.Parallel()
+
+	b := newTestBroker(t)
+	url := b.url()
+	_ = b.l.Close()
+
+	c := Connect(Options{Broker: url, Timeout: time.Second, MaxReconnectInterval: 100 * time.Millisecond})
+	defer c.Close()
+
+	if err := c.Publish("energy/test", 0, false, nil); err != ErrNotConnected {
+		t.Fatalf("expected %v, got %v", ErrNotConnected, err)
+	}
+}
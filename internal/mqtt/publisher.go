@@ -0,0 +1,272 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/energy"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// message is a message to publish.
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// EnergyTotaler provides energy totals of plants.
+type EnergyTotaler interface {
+	Totals(name string, now time.Time) energy.Periods
+}
+
+// DeviceLister lists the devices of a plant.
+type DeviceLister interface {
+	Devices() []plant.DeviceInfo
+}
+
+// Publisher publishes the summaries of plants.
+type Publisher struct {
+	Client *Client
+	// Prefix is the prefix of all topics, e.g. energy.
+	Prefix   string
+	QoS      byte
+	Retained bool
+	// Energy provides the totals of the current day of each plant, nil to not publish totals.
+	Energy EnergyTotaler
+	// DiscoveryPrefix is the prefix of Home Assistant discovery topics, e.g. homeassistant. Discovery is disabled if
+	// it is empty.
+	DiscoveryPrefix string
+	// Devices provides the identity of the devices of each plant for discovery, nil to not describe devices.
+	Devices map[string]DeviceLister
+}
+
+// kind describes the unit and classes of a sensor for Home Assistant.
+type kind struct {
+	unit, deviceClass, stateClass string
+}
+
+var (
+	kindPower  = kind{unit: "W", deviceClass: "power", stateClass: "measurement"}
+	kindSoC    = kind{unit: "%", deviceClass: "battery", stateClass: "measurement"}
+	kindEnergy = kind{unit: "Wh", deviceClass: "energy", stateClass: "total_increasing"}
+)
+
+// sensor is a value of a plant published to its own topic.
+type sensor struct {
+	// path is the topic relative to the topic of the plant, e.g. pv.
+	path  string
+	name  string
+	value float64
+	kind  kind
+	// device is the address of the device of the sensor, empty for values of the plant.
+	device string
+}
+
+// sensors returns the values of the summary and the totals, which may be nil.
+// Values the plant doesn't have, e.g. the grid power without a grid meter, are omitted.
+func sensors(s plant.Summary, totals *energy.Totals) []sensor {
+	ss := []sensor{{path: "pv", name: "PV power", value: float64(s.PV), kind: kindPower}}
+	if s.HasGrid {
+		ss = append(ss,
+			sensor{path: "grid", name: "Grid power", value: float64(s.Grid), kind: kindPower},
+			sensor{path: "selfConsumption", name: "Self consumption", value: float64(s.SelfConsumption), kind: kindPower},
+		)
+	}
+	if s.HasBattery {
+		ss = append(ss,
+			sensor{path: "battery", name: "Battery power", value: float64(s.Bat), kind: kindPower},
+			sensor{path: "batterySoC", name: "Battery SoC", value: float64(s.BatPercentage), kind: kindSoC},
+		)
+	}
+	// readings of the grid meter are 0 if not available
+	if s.GridImportEnergy > 0 || s.GridExportEnergy > 0 {
+		ss = append(ss,
+			sensor{path: "gridImportEnergy", name: "Grid import", value: s.GridImportEnergy, kind: kindEnergy},
+			sensor{path: "gridExportEnergy", name: "Grid export", value: s.GridExportEnergy, kind: kindEnergy},
+		)
+	}
+
+	if totals != nil {
+		// the totals of a day start at 0 each day, which Home Assistant treats as a reset
+		for _, t := range []struct {
+			path, name string
+			value      float64
+		}{
+			{"pv", "PV energy today", totals.PV},
+			{"gridImport", "Grid import today", totals.GridImport},
+			{"gridExport", "Grid export today", totals.GridExport},
+			{"batteryCharge", "Battery charge today", totals.BatCharge},
+			{"batteryDischarge", "Battery discharge today", totals.BatDischarge},
+			{"consumption", "Consumption today", totals.Consumption},
+		} {
+			ss = append(ss, sensor{path: "energy/" + t.path, name: t.name, value: t.value, kind: kindEnergy})
+		}
+	}
+
+	for _, d := range s.Devices {
+		if d.Type == plant.DeviceTypeUnknown || d.Unused {
+			continue
+		}
+
+		path := "devices/" + topicID(d.Address) + "/"
+		ss = append(ss, sensor{path: path + "power", name: "Power", value: float64(d.Power), kind: kindPower,
+			device: d.Address})
+		if d.Type == plant.DeviceTypeBattery {
+			ss = append(ss, sensor{path: path + "soc", name: "SoC", value: float64(d.SoC), kind: kindSoC,
+				device: d.Address})
+		}
+	}
+
+	return ss
+}
+
+var invalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// topicID returns the string with all characters except letters, digits, _ and - replaced by _, e.g. for addresses.
+func topicID(s string) string {
+	return invalidIDChars.ReplaceAllString(s, "_")
+}
+
+// summaryPayload is the combined JSON payload of a summary, like the summaries of the API.
+type summaryPayload struct {
+	Grid            *float32 `json:"grid"`
+	PV              float32  `json:"pv"`
+	Bat             *float32 `json:"battery"`
+	SelfConsumption *float32 `json:"selfConsumption"`
+	BatPercentage   *uint    `json:"batterySoC"`
+	TimestampStart  int64    `json:"timestampStart"`
+	TimestampEnd    int64    `json:"timestampEnd"`
+}
+
+// messages returns a message per sensor of the plant and a combined JSON summary.
+func (p *Publisher) messages(name string, s plant.Summary, ss []sensor) ([]message, error) {
+	ms := make([]message, 0, len(ss)+1)
+	for _, v := range ss {
+		// power values are float32, energy values are float64 and exceed the precision of a float32
+		bitSize := 32
+		if v.kind == kindEnergy {
+			bitSize = 64
+		}
+		payload := strconv.FormatFloat(v.value, 'f', -1, bitSize)
+		ms = append(ms, message{p.stateTopic(name, v.path), []byte(payload)})
+	}
+
+	sp := summaryPayload{
+		PV:             s.PV,
+		TimestampStart: s.TimestampStart.Unix(),
+		TimestampEnd:   s.TimestampEnd.Unix(),
+	}
+	if s.HasGrid {
+		sp.Grid, sp.SelfConsumption = &s.Grid, &s.SelfConsumption
+	}
+	if s.HasBattery {
+		sp.Bat, sp.BatPercentage = &s.Bat, &s.BatPercentage
+	}
+
+	b, err := json.Marshal(sp)
+	if err != nil {
+		return nil, err
+	}
+	return append(ms, message{p.stateTopic(name, "summary"), b}), nil
+}
+
+// stateTopic returns the topic of the path of the plant. Special characters of the plant name are replaced like in
+// topicID, so names containing e.g. / or + don't create invalid or nested topics.
+func (p *Publisher) stateTopic(name, path string) string {
+	return fmt.Sprintf("%v/%v/%v", p.Prefix, topicID(name), path)
+}
+
+// Run publishes every new summary of each plant until ctx is done, see sensors for the topics.
+//
+// Summaries received while the client is disconnected are dropped. Discovery configs are published once, and again
+// whenever they change or the client reconnected.
+func (p *Publisher) Run(ctx context.Context, plants map[string]plant.Subscriber) {
+	for k, v := range plants {
+		go func(name string, sub plant.Subscriber) {
+			summaries, unsubscribe := sub.Subscribe()
+			defer unsubscribe()
+
+			// only changes of the error are logged, as summaries are published every second
+			var lastErr error
+			// discovered contains the published discovery configs by topic
+			discovered := make(map[string]string)
+			var connects uint32
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case s, ok := <-summaries:
+					if !ok {
+						return
+					}
+
+					if c := p.Client.Connects(); c != connects {
+						discovered, connects = make(map[string]string), c
+					}
+
+					err := p.publish(name, s, discovered)
+					switch {
+					case err != nil && (lastErr == nil || err.Error() != lastErr.Error()):
+						log.Println(errors.Wrap(err, fmt.Sprintf("error publishing summary of plant %v", name)))
+					case err == nil && lastErr != nil:
+						log.Printf("publishing summaries of plant %v again", name)
+					}
+					lastErr = err
+				}
+			}
+		}(k, v)
+	}
+}
+
+// publish publishes the summary of the plant and the discovery configs which aren't in discovered yet.
+func (p *Publisher) publish(name string, s plant.Summary, discovered map[string]string) error {
+	var totals *energy.Totals
+	if p.Energy != nil {
+		t := p.Energy.Totals(name, s.TimestampEnd).Day.Totals
+		totals = &t
+	}
+	ss := sensors(s, totals)
+
+	if p.DiscoveryPrefix != "" {
+		var identities map[string]plant.Identity
+		if l, ok := p.Devices[name]; ok {
+			identities = make(map[string]plant.Identity)
+			for _, d := range l.Devices() {
+				identities[d.Address] = d.Identity
+			}
+		}
+
+		ms, err := p.discovery(name, ss, identities)
+		if err != nil {
+			return err
+		}
+		for _, m := range ms {
+			if discovered[m.topic] == string(m.payload) {
+				continue
+			}
+			// discovery configs are always retained, so Home Assistant finds them after a restart
+			err := p.Client.Publish(m.topic, p.QoS, true, m.payload)
+			if err != nil {
+				return errors.Wrap(err, "publishing discovery")
+			}
+			discovered[m.topic] = string(m.payload)
+		}
+	}
+
+	ms, err := p.messages(name, s, ss)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		err := p.Client.Publish(m.topic, p.QoS, p.Retained, m.payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
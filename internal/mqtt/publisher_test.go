@@ -0,0 +1,205 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/orlopau/go-sma-api/internal/energy"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPublisher_messages(t *testing.T) {
+	t.Parallel()
+
+	ts := time.Unix(1608579392, 0)
+
+	tests := []struct {
+		name    string
+		summary plant.Summary
+		totals  *energy.Totals
+		ex      map[string]string
+	}{
+		{
+			name: "Full",
+			summary: plant.Summary{
+				Grid: 1.5, PV: 2000, Bat: -120, SelfConsumption: 1881.5, BatPercentage: 45,
+				GridImportEnergy: 1000, GridExportEnergy: 2000,
+				HasGrid: true, HasBattery: true, TimestampStart: ts, TimestampEnd: ts,
+			},
+			ex: map[string]string{
+				"energy/plant1/grid":             "1.5",
+				"energy/plant1/pv":               "2000",
+				"energy/plant1/battery":          "-120",
+				"energy/plant1/selfConsumption":  "1881.5",
+				"energy/plant1/batterySoC":       "45",
+				"energy/plant1/gridImportEnergy": "1000",
+				"energy/plant1/gridExportEnergy": "2000",
+				"energy/plant1/summary": `{"grid":1.5,"pv":2000,"battery":-120,"selfConsumption":1881.5,` +
+					`"batterySoC":45,"timestampStart":1608579392,"timestampEnd":1608579392}`,
+			},
+		},
+		{
+			name:    "PVOnly",
+			summary: plant.Summary{PV: 2000, TimestampStart: ts, TimestampEnd: ts},
+			ex: map[string]string{
+				"energy/plant1/pv": "2000",
+				"energy/plant1/summary": `{"grid":null,"pv":2000,"battery":null,"selfConsumption":null,` +
+					`"batterySoC":null,"timestampStart":1608579392,"timestampEnd":1608579392}`,
+			},
+		},
+		{
+			name: "LargeEnergy",
+			summary: plant.Summary{
+				PV: 2000, GridImportEnergy: 16777217.5, GridExportEnergy: 123456789.25,
+				HasGrid: true, TimestampStart: ts, TimestampEnd: ts,
+			},
+			totals: &energy.Totals{PV: 16777217.5},
+			ex: map[string]string{
+				"energy/plant1/grid":                    "0",
+				"energy/plant1/pv":                      "2000",
+				"energy/plant1/selfConsumption":         "0",
+				"energy/plant1/gridImportEnergy":        "16777217.5",
+				"energy/plant1/gridExportEnergy":        "123456789.25",
+				"energy/plant1/energy/pv":               "16777217.5",
+				"energy/plant1/energy/gridImport":       "0",
+				"energy/plant1/energy/gridExport":       "0",
+				"energy/plant1/energy/batteryCharge":    "0",
+				"energy/plant1/energy/batteryDischarge": "0",
+				"energy/plant1/energy/consumption":      "0",
+				"energy/plant1/summary": `{"grid":0,"pv":2000,"battery":null,"selfConsumption":0,` +
+					`"batterySoC":null,"timestampStart":1608579392,"timestampEnd":1608579392}`,
+			},
+		},
+		{
+			name: "DevicesAndTotals",
+			summary: plant.Summary{
+				PV: 2000,
+				Devices: []plant.DeviceSummary{
+					{Address: "192.168.188.30:502", Type: plant.DeviceTypePV, Power: 2000},
+					{Address: "192.168.188.34:502", Type: plant.DeviceTypeBattery, Power: -100, SoC: 50},
+					{Address: "192.168.188.35:502", Type: plant.DeviceTypeUnknown},
+				},
+				TimestampStart: ts,
+				TimestampEnd:   ts,
+			},
+			totals: &energy.Totals{PV: 1200.5, Consumption: 800},
+			ex: map[string]string{
+				"energy/plant1/pv": "2000",
+				"energy/plant1/devices/192_168_188_30_502/power": "2000",
+				"energy/plant1/devices/192_168_188_34_502/power": "-100",
+				"energy/plant1/devices/192_168_188_34_502/soc":   "50",
+				"energy/plant1/energy/pv":                        "1200.5",
+				"energy/plant1/energy/gridImport":                "0",
+				"energy/plant1/energy/gridExport":                "0",
+				"energy/plant1/energy/batteryCharge":             "0",
+				"energy/plant1/energy/batteryDischarge":          "0",
+				"energy/plant1/energy/consumption":               "800",
+				"energy/plant1/summary": `{"grid":null,"pv":2000,"battery":null,"selfConsumption":null,` +
+					`"batterySoC":null,"timestampStart":1608579392,"timestampEnd":1608579392}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := &Publisher{Prefix: "energy"}
+			ms, err := p.messages("plant1", tt.summary, sensors(tt.summary, tt.totals))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string, len(ms))
+			for _, m := range ms {
+				got[m.topic] = string(m.payload)
+			}
+			if !reflect.DeepEqual(got, tt.ex) {
+				t.Fatalf("expected %v, got %v", tt.ex, got)
+			}
+		})
+	}
+}
+
+func TestPublisher_messages_plantName(t *testing.T) {
+	t.Parallel()
+
+	p := &Publisher{Prefix: "energy"}
+	s := plant.Summary{PV: 2000}
+	ms, err := p.messages("plant 1/#+", s, sensors(s, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range ms {
+		if m.topic != "energy/plant_1___/pv" && m.topic != "energy/plant_1___/summary" {
+			t.Fatalf("unexpected topic %q", m.topic)
+		}
+	}
+}
+
+type dummySubscriber chan plant.Summary
+
+func (d dummySubscriber) Subscribe() (<-chan plant.Summary, func()) {
+	return d, func() {}
+}
+
+func TestPublisher_Run(t *testing.T) {
+	t.Parallel()
+
+	b := newTestBroker(t)
+	c := Connect(testOptions(b))
+	defer c.Close()
+
+	waitFor(t, "expected connection", func() bool {
+		_, ok := b.retainedMessage("energy/status")
+		return ok
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := make(dummySubscriber)
+	p := &Publisher{Client: c, Prefix: "energy", QoS: 1, Retained: true, DiscoveryPrefix: "homeassistant"}
+	p.Run(ctx, map[string]plant.Subscriber{"plant1": sub})
+
+	sub <- plant.Summary{PV: 2000, Grid: -500, HasGrid: true}
+	sub <- plant.Summary{PV: 1000, Grid: 0, HasGrid: true}
+
+	waitFor(t, "expected retained summary", func() bool {
+		pv, _ := b.retainedMessage("energy/plant1/pv")
+		grid, _ := b.retainedMessage("energy/plant1/grid")
+		return pv.payload == "1000" && pv.qos == 1 && grid.payload == "0"
+	})
+
+	// discovery is published once
+	const config = "homeassistant/sensor/energy_plant1/pv/config"
+	if n := len(b.payloads(config)); n != 1 {
+		t.Fatalf("expected discovery to be published once, got %v times", n)
+	}
+	m, ok := b.retainedMessage(config)
+	if !ok {
+		t.Fatal("expected retained discovery config")
+	}
+	var dc discoveryConfig
+	err := json.Unmarshal([]byte(m.payload), &dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dc.StateTopic != "energy/plant1/pv" || dc.AvailabilityTopic != "energy/status" {
+		t.Fatalf("unexpected discovery config %+v", dc)
+	}
+
+	// discovery is published again after reconnecting
+	b.kick()
+	waitFor(t, "expected reconnect", func() bool {
+		return c.Connects() == 2
+	})
+	sub <- plant.Summary{PV: 1000}
+	sub <- plant.Summary{PV: 1000}
+	if n := len(b.payloads(config)); n != 2 {
+		t.Fatalf("expected discovery to be published again, got %v times", n)
+	}
+}
@@ -0,0 +1,52 @@
+package plant
+
+import "sync"
+
+// broadcaster distributes summaries to subscribers without ever blocking the publisher.
+//
+// Each subscriber only holds the latest summary, stale summaries are dropped if a subscriber is slow.
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan Summary]struct{}
+}
+
+func (b *broadcaster) subscribe() (<-chan Summary, func()) {
+	c := make(chan Summary, 1)
+
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan Summary]struct{})
+	}
+	b.subs[c] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, c)
+			b.mu.Unlock()
+			close(c)
+		})
+	}
+}
+
+func (b *broadcaster) publish(s Summary) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c := range b.subs {
+		select {
+		case c <- s:
+			continue
+		default:
+		}
+
+		// drop the stale summary, the subscriber didn't consume it yet
+		select {
+		case <-c:
+		default:
+		}
+		c <- s
+	}
+}
@@ -1,10 +1,12 @@
 package plant
 
 import (
+	"context"
 	"fmt"
 	"github.com/orlopau/go-energy/pkg/meter"
 	"github.com/orlopau/go-energy/pkg/sunspec"
 	"github.com/pkg/errors"
+	"sync"
 	"time"
 )
 
@@ -22,15 +24,65 @@ var activePowerFeedObis = meter.OBISIdentifier{
 	Tariff:   0,
 }
 
+var activeEnergyDrawObis = meter.OBISIdentifier{
+	Channel:  0,
+	MeasVal:  1,
+	MeasType: 8,
+	Tariff:   0,
+}
+
+var activeEnergyFeedObis = meter.OBISIdentifier{
+	Channel:  0,
+	MeasVal:  2,
+	MeasType: 8,
+	Tariff:   0,
+}
+
+// phaseObisOffset is the offset of the measured value of each phase to the total value.
+var phaseObisOffset = [...]uint8{20, 40, 60}
+
+// measured values of a phase, offset by phaseObisOffset
+const (
+	phaseMeasValPowerDraw   = 1
+	phaseMeasValPowerFeed   = 2
+	phaseMeasValCurrent     = 11
+	phaseMeasValVoltage     = 12
+	phaseMeasValPowerFactor = 13
+)
+
 const (
 	wattsResolution = 0.1
+	// milliResolution converts voltage, current and power factor of a phase, which are in thousandths.
+	milliResolution = 0.001
+	// wattHoursResolution converts the energy counters of the energymeter, which are in watt seconds.
+	wattHoursResolution = 1.0 / 3600
 	// refreshTime is the time after which new values are fetched from SunSpec devices.
-	refreshTime     = 5 * time.Second
+	refreshTime = 5 * time.Second
+	// defaultStaleAfter is the minimum age of stale summaries of a ContinuousFetchPlant.
+	defaultStaleAfter = 10 * time.Second
+	// readTimeout is the maximum time of reading a single value from a SunSpec device.
+	readTimeout = 10 * time.Second
+	// writeTimeout is the maximum time of writing a setpoint, which isn't abandoned if the request is cancelled.
+	writeTimeout = 10 * time.Second
+	// meterTimeout is the maximum time of waiting for a telegram of the energy meter, which sends one every second.
+	meterTimeout = 10 * time.Second
+	// retryDelay is the minimum time between two fetches of a plant after a failed fetch.
+	retryDelay = time.Second
 )
 
 const (
 	devicePVInverter = iota
 	deviceBatteryInverter
+	deviceMeter
+)
+
+// Device types of a DeviceSummary.
+const (
+	DeviceTypePV      = "pv"
+	DeviceTypeBattery = "battery"
+	DeviceTypeMeter   = "meter"
+	// DeviceTypeUnknown is the type of pending devices.
+	DeviceTypeUnknown = "unknown"
 )
 
 type PointReader interface {
@@ -38,71 +90,293 @@ type PointReader interface {
 	HasAnyPoint(ps ...sunspec.Point) (bool, sunspec.Point, error)
 }
 
+// GridReading is a measurement at the grid connection point of a plant.
+type GridReading struct {
+	// Power is the power drawn from the grid, negative if power is fed into the grid.
+	Power float32
+	// ImportEnergy and ExportEnergy are the meter readings in Wh, 0 if the meter doesn't provide them.
+	ImportEnergy, ExportEnergy float64
+	// Phases contains the measurements of each phase, nil if the meter doesn't provide them.
+	Phases []Phase
+}
+
+// Phase is a measurement of a single phase at the grid connection point.
+type Phase struct {
+	// Power is the power drawn from the grid on this phase, negative if power is fed into the grid.
+	Power       float32
+	Voltage     float32
+	Current     float32
+	PowerFactor float32
+}
+
 type GridMeter struct {
 	EM           *meter.EnergyMeter
 	SerialNumber uint32
+
+	m sync.Mutex
+	// pending receives the result of a read which was abandoned because its context was done, nil if there is none.
+	pending chan telegramResult
+}
+
+type telegramResult struct {
+	tg  *meter.EnergyMeterTelegram
+	err error
+}
+
+// Device is a SunSpec device of a plant.
+type Device struct {
+	// Address is the address the device is connected to, used to identify the device.
+	Address string
+	// SlaveID is the modbus slave id of the device, only used to describe it.
+	SlaveID byte
+	Reader  PointReader
+	// Capacity is the usable capacity of a battery in Wh, used to weight the SoC of multiple batteries.
+	// It is 0 if unknown.
+	Capacity float64
+	// Limits are the safety bounds of setpoints of a battery, nil if the battery must not be controlled.
+	Limits *BatteryLimits
+	// LimitPower allows limiting the active power of a PV inverter.
+	LimitPower bool
+}
+
+// DeviceSummary contains the values of a single device of a plant.
+type DeviceSummary struct {
+	Address string
+	Type    string
+	Power   float32
+	// SoC is the state of charge of battery inverters.
+	SoC uint
+	// Capacity is the configured capacity of battery inverters in Wh, 0 if unknown.
+	Capacity float64
+	// LastRead is the time of the last successful read.
+	LastRead time.Time
+	// Err is the error of the last read, nil if it succeeded.
+	Err error
+	// Connection is the connection state of supervised devices.
+	Connection ConnState
+	// Unused is true for devices which aren't read, e.g. a SunSpec meter of a plant with an energy meter. Their
+	// values are 0.
+	Unused bool
 }
 
 type inverter struct {
 	mr            PointReader
+	addr          string
+	m             sync.Mutex
 	lastPower     float32
 	lastPowerTime time.Time
+	lastErr       error
+	// limiter is nil if the power of the inverter must not be limited.
+	limiter *powerLimiter
 }
 
 type batteryInverter struct {
 	inverter
+	// control is nil if the battery must not be controlled.
+	control     *batteryController
+	capacity    float64
 	lastSoc     uint
 	lastSocTime time.Time
 }
 
-func (g *GridMeter) ReadGrid() (float32, error) {
+// ReadGrid waits for the next telegram of the energy meter with the serial number. It fails if no telegram is received
+// within meterTimeout.
+func (g *GridMeter) ReadGrid(ctx context.Context) (GridReading, error) {
+	ctx, cancel := context.WithTimeout(ctx, meterTimeout)
+	defer cancel()
+
 	for {
-		tg, err := g.EM.ReadTelegram()
+		tg, err := g.readTelegram(ctx)
 		if err != nil {
-			return 0, err
+			return GridReading{}, err
 		}
 		if tg.SerialNo == g.SerialNumber {
 			powerDraw, ok := tg.Obis[activePowerDrawObis]
 			if !ok {
-				return 0, fmt.Errorf("no active power draw found in telegram")
+				return GridReading{}, fmt.Errorf("no active power draw found in telegram")
 			}
 
 			powerFeed, ok := tg.Obis[activePowerFeedObis]
 			if !ok {
-				return 0, fmt.Errorf("no active power feed found in telegram")
+				return GridReading{}, fmt.Errorf("no active power feed found in telegram")
+			}
+
+			reading := GridReading{
+				Power: (float32(powerDraw) - float32(powerFeed)) * wattsResolution,
 			}
 
-			return (float32(powerDraw) - float32(powerFeed)) * wattsResolution, nil
+			// energy counters are optional, the power is still valid without them
+			energyDraw, okDraw := tg.Obis[activeEnergyDrawObis]
+			energyFeed, okFeed := tg.Obis[activeEnergyFeedObis]
+			if okDraw && okFeed {
+				reading.ImportEnergy = float64(energyDraw) * wattHoursResolution
+				reading.ExportEnergy = float64(energyFeed) * wattHoursResolution
+			}
+
+			reading.Phases = readPhases(tg)
+
+			return reading, nil
 		}
 	}
 }
 
-func (p *inverter) ReadPower() (float32, error) {
+// readTelegram reads the next telegram, or returns the error of the context if it is done first.
+//
+// The read continues in the background if the context is done, the next call waits for its telegram instead of
+// starting another read. This way reads don't pile up while the energy meter is offline, and no telegram is lost.
+func (g *GridMeter) readTelegram(ctx context.Context) (*meter.EnergyMeterTelegram, error) {
+	g.m.Lock()
+	c := g.pending
+	g.pending = nil
+	if c == nil {
+		c = make(chan telegramResult, 1)
+		go func() {
+			tg, err := g.EM.ReadTelegram()
+			c <- telegramResult{tg, err}
+		}()
+	}
+	g.m.Unlock()
+
+	select {
+	case res := <-c:
+		return res.tg, res.err
+	case <-ctx.Done():
+		g.m.Lock()
+		g.pending = c
+		g.m.Unlock()
+		return nil, errors.Wrap(ctx.Err(), "waiting for energy meter telegram")
+	}
+}
+
+// getAnyPoint reads the first available point like PointReader.GetAnyPoint, or returns the error of the context if it
+// is done first. The read continues in the background if the context is done, the value is discarded then.
+func getAnyPoint(ctx context.Context, r PointReader, ps ...sunspec.Point) (float64, error) {
+	type result struct {
+		v   float64
+		err error
+	}
+
+	c := make(chan result, 1)
+	go func() {
+		v, err := r.GetAnyPoint(ps...)
+		c <- result{v, err}
+	}()
+
+	select {
+	case res := <-c:
+		return res.v, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// readPhases reads the measurements of all three phases from the telegram.
+//
+// Returns nil if the power of any phase is missing. Voltage, current and power factor are 0 if missing.
+func readPhases(tg *meter.EnergyMeterTelegram) []Phase {
+	phases := make([]Phase, len(phaseObisOffset))
+
+	obis := func(offset, measVal uint8) (uint64, bool) {
+		v, ok := tg.Obis[meter.OBISIdentifier{Channel: 0, MeasVal: offset + measVal, MeasType: 4, Tariff: 0}]
+		return v, ok
+	}
+
+	for i, offset := range phaseObisOffset {
+		powerDraw, okDraw := obis(offset, phaseMeasValPowerDraw)
+		powerFeed, okFeed := obis(offset, phaseMeasValPowerFeed)
+		if !okDraw || !okFeed {
+			return nil
+		}
+
+		current, _ := obis(offset, phaseMeasValCurrent)
+		voltage, _ := obis(offset, phaseMeasValVoltage)
+		powerFactor, _ := obis(offset, phaseMeasValPowerFactor)
+
+		phases[i] = Phase{
+			Power:       (float32(powerDraw) - float32(powerFeed)) * wattsResolution,
+			Voltage:     float32(float64(voltage) * milliResolution),
+			Current:     float32(float64(current) * milliResolution),
+			PowerFactor: float32(float64(powerFactor) * milliResolution),
+		}
+	}
+
+	return phases
+}
+
+func (p *inverter) ReadPower(ctx context.Context) (float32, error) {
+	p.m.Lock()
 	if time.Now().Sub(p.lastPowerTime).Milliseconds() <= refreshTime.Milliseconds() {
+		defer p.m.Unlock()
 		return p.lastPower, nil
 	}
+	p.m.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+	pow, err := getAnyPoint(ctx, p.mr, sunspec.PointPower1Phase, sunspec.PointPower2Phase, sunspec.PointPower3Phase)
 
-	pow, err := p.mr.GetAnyPoint(sunspec.PointPower1Phase, sunspec.PointPower2Phase, sunspec.PointPower3Phase)
+	p.m.Lock()
+	defer p.m.Unlock()
 
 	// can be "not implemented" at night
 	if err != nil && !errors.Is(err, sunspec.ErrPointNotImplemented) {
-		return 0, err
+		return p.lastPower, p.failed(err)
 	}
 
-
+	p.lastErr = nil
 	p.lastPower = float32(pow)
 	p.lastPowerTime = time.Now()
 	return p.lastPower, nil
 }
 
-func (b *batteryInverter) ReadSoC() (uint, error) {
-	if time.Now().Sub(b.lastPowerTime).Milliseconds() <= refreshTime.Milliseconds() {
+// failed records the error of a read for the device summary and returns it.
+//
+// Must be called with the lock held.
+func (p *inverter) failed(err error) error {
+	p.lastErr = err
+	return errors.Wrap(err, fmt.Sprintf("reading device %v", p.addr))
+}
+
+func (p *inverter) connState() ConnState {
+	return connStateOf(p.mr)
+}
+
+func (p *inverter) deviceSummary() DeviceSummary {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	s := DeviceSummary{
+		Address:    p.addr,
+		Type:       DeviceTypePV,
+		Power:      p.lastPower,
+		LastRead:   p.lastPowerTime,
+		Err:        p.lastErr,
+		Connection: connStateOf(p.mr),
+	}
+	// disconnected devices are left out of the plant
+	if s.Connection.State == ConnStatePending || s.Connection.State == ConnStateReconnecting {
+		s.Power = 0
+	}
+	return s
+}
+
+func (b *batteryInverter) ReadSoC(ctx context.Context) (uint, error) {
+	b.m.Lock()
+	if time.Now().Sub(b.lastSocTime).Milliseconds() <= refreshTime.Milliseconds() {
+		defer b.m.Unlock()
 		return b.lastSoc, nil
 	}
+	b.m.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+	soc, err := getAnyPoint(ctx, b.mr, sunspec.PointSoc)
+
+	b.m.Lock()
+	defer b.m.Unlock()
 
-	soc, err := b.mr.GetAnyPoint(sunspec.PointSoc)
 	if err != nil {
-		return 0, errors.Wrap(err, "reading soc")
+		return b.lastSoc, b.failed(errors.Wrap(err, "reading soc"))
 	}
 
 	b.lastSoc = uint(soc)
@@ -110,6 +384,22 @@ func (b *batteryInverter) ReadSoC() (uint, error) {
 	return b.lastSoc, nil
 }
 
+func (b *batteryInverter) deviceSummary() DeviceSummary {
+	s := b.inverter.deviceSummary()
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	s.Type = DeviceTypeBattery
+	s.SoC = b.lastSoc
+	s.Capacity = b.capacity
+	return s
+}
+
+func (b *batteryInverter) Capacity() float64 {
+	return b.capacity
+}
+
 func getDeviceType(r PointReader) (int, error) {
 	hasPower, _, err := r.HasAnyPoint(sunspec.PointPower1Phase, sunspec.PointPower2Phase, sunspec.PointPower3Phase)
 	if err != nil {
@@ -139,5 +429,14 @@ func getDeviceType(r PointReader) (int, error) {
 		return devicePVInverter, nil
 	}
 
+	hasMeter, _, err := r.HasAnyPoint(meterPowerPoints()...)
+	if err != nil {
+		return 0, err
+	}
+
+	if hasMeter {
+		return deviceMeter, nil
+	}
+
 	return 0, fmt.Errorf("device is not of any known type")
 }
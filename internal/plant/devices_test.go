@@ -0,0 +1,306 @@
+package plant
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/orlopau/go-energy/pkg/meter"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dummyMeterConn returns the encoded telegrams in order.
+type dummyMeterConn struct {
+	telegrams [][]byte
+}
+
+func (d *dummyMeterConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	if len(d.telegrams) == 0 {
+		return 0, nil, fmt.Errorf("no more telegrams")
+	}
+
+	n := copy(b, d.telegrams[0])
+	d.telegrams = d.telegrams[1:]
+	return n, nil, nil
+}
+
+func (d *dummyMeterConn) Close() error {
+	return nil
+}
+
+// encodeTelegram encodes an energymeter telegram containing the given OBIS values.
+func encodeTelegram(serialNo uint32, obis map[meter.OBISIdentifier]uint64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("SMA\x00")
+	buf.Write(make([]byte, 12))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(0x6069))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(349))
+	_ = binary.Write(&buf, binary.BigEndian, serialNo)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(1000))
+
+	for k, v := range obis {
+		_ = binary.Write(&buf, binary.BigEndian, k)
+		if k.MeasType == 8 {
+			_ = binary.Write(&buf, binary.BigEndian, v)
+		} else {
+			_ = binary.Write(&buf, binary.BigEndian, uint32(v))
+		}
+	}
+
+	// end of telegram
+	buf.Write(make([]byte, 8))
+	return buf.Bytes()
+}
+
+func TestGridMeter_ReadGrid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		telegrams [][]byte
+		exReading GridReading
+		exErr     bool
+	}{
+		{
+			name: "PowerAndEnergy",
+			telegrams: [][]byte{
+				// telegrams of other meters are skipped
+				encodeTelegram(2, map[meter.OBISIdentifier]uint64{activePowerDrawObis: 1}),
+				encodeTelegram(1, map[meter.OBISIdentifier]uint64{
+					activePowerDrawObis:  0,
+					activePowerFeedObis:  5000,
+					activeEnergyDrawObis: 36000000,
+					activeEnergyFeedObis: 7200000,
+				}),
+			},
+			exReading: GridReading{Power: -500, ImportEnergy: 10000, ExportEnergy: 2000},
+		},
+		{
+			name: "PowerOnly",
+			telegrams: [][]byte{
+				encodeTelegram(1, map[meter.OBISIdentifier]uint64{
+					activePowerDrawObis: 1000,
+					activePowerFeedObis: 0,
+				}),
+			},
+			exReading: GridReading{Power: 100},
+		},
+		{
+			name: "Phases",
+			telegrams: [][]byte{
+				encodeTelegram(1, map[meter.OBISIdentifier]uint64{
+					activePowerDrawObis:        2000,
+					activePowerFeedObis:        0,
+					{MeasVal: 21, MeasType: 4}: 1000,
+					{MeasVal: 22, MeasType: 4}: 0,
+					{MeasVal: 31, MeasType: 4}: 2000,
+					{MeasVal: 32, MeasType: 4}: 230000,
+					{MeasVal: 33, MeasType: 4}: 500,
+					{MeasVal: 41, MeasType: 4}: 1500,
+					{MeasVal: 42, MeasType: 4}: 0,
+					{MeasVal: 61, MeasType: 4}: 0,
+					{MeasVal: 62, MeasType: 4}: 500,
+				}),
+			},
+			exReading: GridReading{
+				Power: 200,
+				Phases: []Phase{
+					{Power: 100, Voltage: 230, Current: 2, PowerFactor: 0.5},
+					{Power: 150},
+					{Power: -50},
+				},
+			},
+		},
+		{
+			name: "MissingPower",
+			telegrams: [][]byte{
+				encodeTelegram(1, map[meter.OBISIdentifier]uint64{activeEnergyDrawObis: 1000}),
+			},
+			exErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			gm := &GridMeter{
+				EM:           &meter.EnergyMeter{Conn: &dummyMeterConn{telegrams: tt.telegrams}},
+				SerialNumber: 1,
+			}
+
+			reading, err := gm.ReadGrid(context.Background())
+			if err != nil {
+				if tt.exErr {
+					return
+				}
+				t.Fatal(err)
+			}
+			if tt.exErr {
+				t.Fatal("expected error")
+			}
+
+			if !reflect.DeepEqual(reading, tt.exReading) {
+				t.Fatalf("expected %+v, got %+v", tt.exReading, reading)
+			}
+		})
+	}
+}
+
+func Test_inverter_ReadPower_error(t *testing.T) {
+	t.Parallel()
+
+	inv := &inverter{
+		mr:            &dummyPointReader{err: fmt.Errorf("dummy error")},
+		addr:          "device0",
+		lastPower:     100,
+		lastPowerTime: time.Now().Add(-refreshTime - time.Second),
+	}
+
+	// the error is returned at once and reported in the device summary
+	_, err := inv.ReadPower(context.Background())
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if s := inv.deviceSummary(); s.Err == nil {
+		t.Fatalf("expected device summary with error, got %+v", s)
+	}
+
+	// a successful read clears the error
+	inv.mr = &dummyPointReader{points: map[sunspec.Point]float64{sunspec.PointPower3Phase: 200}}
+	power, err := inv.ReadPower(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := inv.deviceSummary(); s.Err != nil || power != 200 {
+		t.Fatalf("expected device summary without error, got %+v", s)
+	}
+}
+
+// blockingPointReader blocks every read until release is closed.
+type blockingPointReader struct {
+	release chan struct{}
+}
+
+func (b *blockingPointReader) GetAnyPoint(ps ...sunspec.Point) (float64, error) {
+	<-b.release
+	return 0, fmt.Errorf("released")
+}
+
+func (b *blockingPointReader) HasAnyPoint(ps ...sunspec.Point) (bool, sunspec.Point, error) {
+	<-b.release
+	return false, sunspec.Point{}, fmt.Errorf("released")
+}
+
+func Test_inverter_ReadPower_timeout(t *testing.T) {
+	t.Parallel()
+
+	r := &blockingPointReader{release: make(chan struct{})}
+	defer close(r.release)
+
+	inv := &inverter{mr: r, addr: "device0"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := inv.ReadPower(ctx)
+	if ErrorClass(err) != ErrorClassTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+// blockingMeterConn blocks every read until release is closed.
+type blockingMeterConn struct {
+	release chan struct{}
+}
+
+func (b *blockingMeterConn) ReadFromUDP([]byte) (int, *net.UDPAddr, error) {
+	<-b.release
+	return 0, nil, fmt.Errorf("released")
+}
+
+func (b *blockingMeterConn) Close() error {
+	return nil
+}
+
+func TestGridMeter_ReadGrid_cancel(t *testing.T) {
+	t.Parallel()
+
+	conn := &blockingMeterConn{release: make(chan struct{})}
+	defer close(conn.release)
+
+	gm := &GridMeter{EM: &meter.EnergyMeter{Conn: conn}, SerialNumber: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := gm.ReadGrid(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+}
+
+// countingMeterConn returns a telegram for each value sent to telegrams and counts the reads.
+type countingMeterConn struct {
+	telegrams chan []byte
+
+	m     sync.Mutex
+	reads int
+}
+
+func (c *countingMeterConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	c.m.Lock()
+	c.reads++
+	c.m.Unlock()
+
+	return copy(b, <-c.telegrams), nil, nil
+}
+
+func (c *countingMeterConn) Close() error {
+	return nil
+}
+
+func TestGridMeter_ReadGrid_resumeRead(t *testing.T) {
+	t.Parallel()
+
+	conn := &countingMeterConn{telegrams: make(chan []byte)}
+	gm := &GridMeter{EM: &meter.EnergyMeter{Conn: conn}, SerialNumber: 1}
+
+	// the meter is offline for multiple fetches
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err := gm.ReadGrid(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected timeout, got %v", err)
+		}
+	}
+
+	// the telegram of the abandoned read is used once the meter is back
+	go func() {
+		conn.telegrams <- encodeTelegram(1, map[meter.OBISIdentifier]uint64{
+			activePowerDrawObis: 10000,
+			activePowerFeedObis: 0,
+		})
+	}()
+	reading, err := gm.ReadGrid(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reading.Power != 1000 {
+		t.Fatalf("expected power 1000, got %v", reading.Power)
+	}
+
+	conn.m.Lock()
+	defer conn.m.Unlock()
+	if conn.reads != 1 {
+		t.Fatalf("expected a single read, got %v", conn.reads)
+	}
+}
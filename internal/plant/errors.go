@@ -0,0 +1,60 @@
+package plant
+
+import (
+	"context"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Error classes returned by ErrorClass.
+const (
+	ErrorClassNoData     = "no_data"
+	ErrorClassTimeout    = "timeout"
+	ErrorClassConnection = "connection"
+	ErrorClassDevice     = "device"
+	ErrorClassUnknown    = "unknown"
+)
+
+// ErrNoData is returned if a plant did not produce any summary yet.
+var ErrNoData = errors.New("no data")
+
+// FetchError is returned by a ContinuousFetchPlant if the latest fetch failed.
+type FetchError struct {
+	Err error
+	// Since is the time of the first failed fetch after the last successful one.
+	Since time.Time
+}
+
+func (e *FetchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClass categorizes an error returned while fetching a plant, e.g. to distinguish unreachable devices from
+// devices returning unexpected data.
+func ErrorClass(err error) string {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, ErrNoData):
+		return ErrorClassNoData
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, ErrDisconnected), errors.As(err, &netErr):
+		return ErrorClassConnection
+	case errors.Is(err, sunspec.ErrPointNotImplemented):
+		return ErrorClassDevice
+	default:
+		return ErrorClassUnknown
+	}
+}
@@ -0,0 +1,192 @@
+package plant
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// exportDeadband is the minimum change of the PV limit in percent.
+	exportDeadband = 1.0
+	// exportMinRevert is the minimum time after which the inverters revert the limit of the export controller.
+	exportMinRevert = 10 * time.Second
+)
+
+// exportController limits the PV inverters of a plant, so the power fed into the grid stays below a limit.
+type exportController struct {
+	p *Plant
+	// limit is the maximum export in W.
+	limit float64
+	// pct is the current limit of the inverters in percent, negative until the first limit was written.
+	pct float64
+	// revert is the revert timeout written with each limit.
+	revert time.Duration
+	// fallbackAfter is the time without summaries after which the fallback limit is written.
+	fallbackAfter time.Duration
+}
+
+// ControlExport limits the PV inverters of the plant, so the power fed into the grid stays below limit W.
+// The grid and PV power are taken from the summaries of sub, so the plant is controlled at its fetch interval.
+//
+// Each limit is written with a revert timeout of 3 intervals, but at least exportMinRevert, and written again on
+// each summary, so the inverters return to full power on their own if the server stops. If the summaries are stale or
+// stop for half the revert timeout, e.g. because the meter is offline, the inverters are limited to the export limit
+// without a revert timeout instead, so the export stays below the limit regardless of the consumption.
+//
+// Manual limits of the PV inverters fail with ErrExportControlled while the controller runs.
+func ControlExport(ctx context.Context, p *Plant, sub Subscriber, limit float64, interval time.Duration) error {
+	if limit < 0 {
+		return fmt.Errorf("export limit must not be negative")
+	}
+
+	revert := exportMinRevert
+	if 3*interval > revert {
+		revert = 3 * interval
+	}
+	if revert.Seconds() > math.MaxUint16 {
+		return fmt.Errorf("fetch interval of %v is too long to control the export", interval)
+	}
+
+	p.m.Lock()
+	if p.exportControlled {
+		p.m.Unlock()
+		return ErrExportControlled
+	}
+	p.exportControlled = true
+	p.m.Unlock()
+
+	c := &exportController{p: p, limit: limit, pct: -1, revert: revert, fallbackAfter: revert / 2}
+	summaries, unsubscribe := sub.Subscribe()
+	go c.run(ctx, summaries, unsubscribe)
+
+	return nil
+}
+
+// run controls the export on each summary until ctx is done.
+func (c *exportController) run(ctx context.Context, summaries <-chan Summary, unsubscribe func()) {
+	defer func() {
+		unsubscribe()
+		c.p.m.Lock()
+		c.p.exportControlled = false
+		c.p.m.Unlock()
+	}()
+
+	watchdog := time.NewTimer(c.fallbackAfter)
+	defer watchdog.Stop()
+
+	// only changes of the error are logged, as there is a summary every second
+	var lastErr error
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-watchdog.C:
+			err = c.fallback(ctx, "no summaries")
+			watchdog.Reset(c.fallbackAfter)
+		case s, ok := <-summaries:
+			if !ok {
+				return
+			}
+			if !watchdog.Stop() {
+				<-watchdog.C
+			}
+			watchdog.Reset(c.fallbackAfter)
+			err = c.step(ctx, s)
+		}
+
+		switch {
+		case err != nil && (lastErr == nil || err.Error() != lastErr.Error()):
+			log.Printf("error controlling export: %v", err)
+		case err == nil && lastErr != nil:
+			log.Println("controlling export again")
+		}
+		lastErr = err
+	}
+}
+
+// step adjusts the limit of the inverters to the summary and restarts their revert timeout.
+func (c *exportController) step(ctx context.Context, s Summary) error {
+	if !s.HasGrid {
+		return c.fallback(ctx, "plant has no grid meter")
+	}
+	if s.Stale {
+		return c.fallback(ctx, "summary is stale")
+	}
+
+	limiters, rated, err := c.limiters(ctx)
+	if err != nil {
+		return err
+	}
+
+	pct := c.target(float64(s.PV), -float64(s.Grid), rated)
+	// small changes are skipped, but the limit is written anyway to restart the revert timeout
+	if c.pct >= 0 && math.Abs(pct-c.pct) < exportDeadband {
+		pct = c.pct
+	}
+
+	return c.set(ctx, limiters, pct, c.revert)
+}
+
+// fallback limits the inverters to the export limit without a revert timeout, as the export is unknown. It returns an
+// error with the reason, so the fallback is logged.
+func (c *exportController) fallback(ctx context.Context, reason string) error {
+	limiters, rated, err := c.limiters(ctx)
+	if err != nil {
+		return errors.Wrap(err, reason)
+	}
+
+	pct := math.Min(100, c.limit/rated*100)
+	err = c.set(ctx, limiters, pct, 0)
+	if err != nil {
+		return errors.Wrap(err, reason)
+	}
+	return fmt.Errorf("%v, limited PV to %.0f%% of the rated power", reason, pct)
+}
+
+// limiters returns the limiters of the PV inverters and their total rated power.
+func (c *exportController) limiters(ctx context.Context) ([]*powerLimiter, float64, error) {
+	limiters, err := c.p.pvLimiters("", true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rated float64
+	for _, l := range limiters {
+		r, err := l.ratedPower(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		rated += r
+	}
+	return limiters, rated, nil
+}
+
+// set writes the limit with the revert timeout to all inverters.
+func (c *exportController) set(ctx context.Context, limiters []*powerLimiter, pct float64, revert time.Duration) error {
+	for _, l := range limiters {
+		err := l.set(ctx, pct, revert)
+		if err != nil {
+			return err
+		}
+	}
+	c.pct = pct
+	return nil
+}
+// target returns the limit in percent of the rated power at which the export reaches the limit.
+// Reductions are applied at once, increases only halfway to avoid overshooting while the inverters ramp up.
+func (c *exportController) target(pv, export, rated float64) float64 {
+	pct := math.Max(0, math.Min(100, (pv+c.limit-export)/rated*100))
+	if c.pct >= 0 && pct > c.pct {
+		pct = c.pct + (pct-c.pct)/2
+		// reach the full power eventually
+		if 100-pct < exportDeadband {
+			pct = 100
+		}
+	}
+	return pct
+}
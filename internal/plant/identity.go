@@ -0,0 +1,99 @@
+package plant
+
+// commonModel is the SunSpec common model, implemented by every SunSpec device.
+const commonModel = 1
+
+// Points of the common model, including the 2 registers of the model header. Strings are given with their length in
+// registers.
+const (
+	commonPointManufacturer = 2
+	commonPointModel        = 18
+	commonPointVersion      = 42
+	commonPointSerialNumber = 50
+
+	commonManufacturerWords = 16
+	commonModelWords        = 16
+	commonVersionWords      = 8
+	commonSerialNumberWords = 16
+)
+
+// stringReader is implemented by readers which can read strings of SunSpec models.
+type stringReader interface {
+	ReadString(model, point, words uint16) (string, error)
+}
+
+// Identity identifies the hardware of a SunSpec device, read from its common model.
+type Identity struct {
+	Manufacturer string
+	Model        string
+	// Version is the firmware version.
+	Version      string
+	SerialNumber string
+}
+
+// DeviceInfo describes a configured device of a plant.
+type DeviceInfo struct {
+	Address string
+	SlaveID byte
+	// Type is one of the DeviceType* constants, DeviceTypeUnknown while the device is pending.
+	Type string
+	// Identity is the zero value while the device is pending or if the reader can't read strings.
+	Identity Identity
+	// Unused is true for devices which aren't read, see DeviceSummary.
+	Unused bool
+}
+
+// readIdentity reads the identity of the device from its common model.
+func readIdentity(r stringReader) (Identity, error) {
+	var id Identity
+
+	fields := []struct {
+		v            *string
+		point, words uint16
+	}{
+		{&id.Manufacturer, commonPointManufacturer, commonManufacturerWords},
+		{&id.Model, commonPointModel, commonModelWords},
+		{&id.Version, commonPointVersion, commonVersionWords},
+		{&id.SerialNumber, commonPointSerialNumber, commonSerialNumberWords},
+	}
+
+	for _, f := range fields {
+		s, err := r.ReadString(commonModel, f.point, f.words)
+		if err != nil {
+			return Identity{}, err
+		}
+		*f.v = s
+	}
+
+	return id, nil
+}
+
+func deviceTypeName(t int) string {
+	switch t {
+	case devicePVInverter:
+		return DeviceTypePV
+	case deviceBatteryInverter:
+		return DeviceTypeBattery
+	case deviceMeter:
+		return DeviceTypeMeter
+	default:
+		return DeviceTypeUnknown
+	}
+}
+
+// Devices returns the configured devices of the plant, including pending devices.
+func (p *Plant) Devices() []DeviceInfo {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	devices := make([]DeviceInfo, len(p.devices))
+	for i, d := range p.devices {
+		devices[i] = DeviceInfo{Address: d.Address, SlaveID: d.SlaveID, Type: DeviceTypeUnknown}
+		if t, ok := p.types[d.Address]; ok {
+			devices[i].Type = deviceTypeName(t)
+			devices[i].Identity = p.identities[d.Address]
+			devices[i].Unused = p.unused[d.Address]
+		}
+	}
+	return devices
+}
@@ -0,0 +1,68 @@
+package plant
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"reflect"
+	"testing"
+)
+
+// identityPointReader is a dummyPointReader with strings of the common model.
+type identityPointReader struct {
+	dummyPointReader
+	strings map[uint16]string
+}
+
+func (r *identityPointReader) ReadString(model, point, words uint16) (string, error) {
+	if model != commonModel {
+		return "", sunspec.ErrPointNotImplemented
+	}
+	return r.strings[point], nil
+}
+
+func TestPlant_Devices(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inverter := &identityPointReader{
+		dummyPointReader: dummyPointReader{points: map[sunspec.Point]float64{sunspec.PointPower1Phase: 100}},
+		strings: map[uint16]string{
+			commonPointManufacturer: "SMA",
+			commonPointModel:        "SB3.0-1AV-41",
+			commonPointVersion:      "3.10.18.R",
+			commonPointSerialNumber: "3005067415",
+		},
+	}
+	offline := Supervise(ctx, "battery", func(addr string) (PointReader, error) {
+		return nil, fmt.Errorf("connection refused")
+	})
+
+	p, err := NewPlant(nil,
+		Device{Address: "inverter", SlaveID: 126, Reader: inverter},
+		Device{Address: "battery", SlaveID: 3, Reader: offline},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []DeviceInfo{
+		{
+			Address: "inverter",
+			SlaveID: 126,
+			Type:    DeviceTypePV,
+			Identity: Identity{
+				Manufacturer: "SMA",
+				Model:        "SB3.0-1AV-41",
+				Version:      "3.10.18.R",
+				SerialNumber: "3005067415",
+			},
+		},
+		{Address: "battery", SlaveID: 3, Type: DeviceTypeUnknown},
+	}
+	if devices := p.Devices(); !reflect.DeepEqual(devices, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, devices)
+	}
+}
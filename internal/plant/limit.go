@@ -0,0 +1,172 @@
+package plant
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Points of the SunSpec nameplate and immediate controls models, including the 2 registers of the model header.
+const (
+	nameplateModel       = 120
+	nameplatePointWRtg   = 3
+	nameplatePointWRtgSF = 4
+
+	controlsModel             = 123
+	controlsPointWMaxLimPct   = 5
+	controlsPointRvrtTms      = 7
+	controlsPointWMaxLimEna   = 9
+	controlsPointWMaxLimPctSF = 23
+)
+
+// ErrExportControlled is returned for limits of PV inverters which are limited by the export controller.
+var ErrExportControlled = errors.New("PV inverters are limited by the export controller")
+
+// powerLimiter limits the active power of a PV inverter using the immediate controls model.
+type powerLimiter struct {
+	addr string
+	mr   PointReader
+
+	m sync.Mutex
+	// rated is the rated power in W, 0 until it was read.
+	rated float64
+}
+
+// ratedPower returns the rated power of the inverter in W, read from the nameplate model once.
+func (l *powerLimiter) ratedPower(ctx context.Context) (float64, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.rated > 0 {
+		return l.rated, nil
+	}
+
+	rated, err := readScaled(ctx, l.mr, nameplateModel, nameplatePointWRtg, nameplatePointWRtgSF, uint16(0))
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("reading rated power of inverter %v", l.addr))
+	}
+	if rated <= 0 {
+		return 0, fmt.Errorf("inverter %v has no rated power", l.addr)
+	}
+
+	l.rated = rated
+	return rated, nil
+}
+
+// set limits the power to pct percent of the rated power. The inverter reverts the limit after the timeout, a timeout
+// of 0 keeps the limit.
+func (l *powerLimiter) set(ctx context.Context, pct float64, timeout time.Duration) error {
+	sf, err := getAnyPoint(ctx, l.mr, sunspec.Point{Model: controlsModel, Point: controlsPointWMaxLimPctSF, T: int16(0)})
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("reading limit scale factor of inverter %v", l.addr))
+	}
+
+	writes := []struct {
+		point uint16
+		value uint16
+	}{
+		{controlsPointWMaxLimPct, toRaw(pct, sf)},
+		{controlsPointRvrtTms, uint16(timeout.Seconds())},
+		{controlsPointWMaxLimEna, 1},
+	}
+	for _, w := range writes {
+		err := writePoint(ctx, l.mr, controlsModel, w.point, w.value)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("writing limit of inverter %v", l.addr))
+		}
+	}
+
+	return nil
+}
+
+// remove disables the limit.
+func (l *powerLimiter) remove(ctx context.Context) error {
+	err := writePoint(ctx, l.mr, controlsModel, controlsPointWMaxLimEna, 0)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("removing limit of inverter %v", l.addr))
+	}
+	return nil
+}
+
+// LimitPV limits the active power of the PV inverter at the address, or of all PV inverters if the address is empty,
+// to pct percent of their rated power. The inverters revert the limit after the timeout, a timeout of 0 keeps the
+// limit until it is removed.
+func (p *Plant) LimitPV(ctx context.Context, addr string, pct float64, timeout time.Duration) error {
+	if err := checkBounds("limit", pct, 0, 100); err != nil {
+		return err
+	}
+	if timeout < 0 || timeout.Seconds() > math.MaxUint16 {
+		return errors.Wrap(ErrInvalidSetpoint, fmt.Sprintf("timeout must be between 0 and %vs", math.MaxUint16))
+	}
+
+	limiters, err := p.pvLimiters(addr, false)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range limiters {
+		err := l.set(ctx, pct, timeout)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovePVLimit removes the limit of the PV inverter at the address, or of all PV inverters if the address is empty.
+func (p *Plant) RemovePVLimit(ctx context.Context, addr string) error {
+	limiters, err := p.pvLimiters(addr, false)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range limiters {
+		err := l.remove(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pvLimiters returns the limiter of the PV inverter at the address, or of all limitable PV inverters if the address is
+// empty. Unless the export controller is the caller, it fails while the export controller is active.
+func (p *Plant) pvLimiters(addr string, exportController bool) ([]*powerLimiter, error) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	if p.exportControlled && !exportController {
+		return nil, ErrExportControlled
+	}
+
+	var limiters []*powerLimiter
+	for _, v := range p.Inverters {
+		inv, ok := v.(*inverter)
+		if !ok {
+			continue
+		}
+
+		if addr != "" && inv.addr == addr {
+			if inv.limiter == nil {
+				return nil, errors.Wrap(ErrNotControllable, fmt.Sprintf("inverter %v must not be limited", addr))
+			}
+			return []*powerLimiter{inv.limiter}, nil
+		}
+		if addr == "" && inv.limiter != nil {
+			limiters = append(limiters, inv.limiter)
+		}
+	}
+
+	switch {
+	case addr != "":
+		return nil, errors.Wrap(ErrDeviceNotFound, fmt.Sprintf("no PV inverter %v", addr))
+	case len(limiters) == 0:
+		return nil, errors.Wrap(ErrNotControllable, "plant has no limitable PV inverter")
+	default:
+		return limiters, nil
+	}
+}
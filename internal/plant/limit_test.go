@@ -0,0 +1,284 @@
+package plant
+
+import (
+	"context"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// controlsPointReader is a PV inverter with writable registers of the immediate controls model.
+type controlsPointReader struct {
+	dummyPointReader
+
+	m         sync.Mutex
+	registers map[sunspec.Point]uint16
+}
+
+func newControlsPointReader(rated uint16) *controlsPointReader {
+	return &controlsPointReader{
+		dummyPointReader: dummyPointReader{points: map[sunspec.Point]float64{
+			sunspec.PointPower1Phase: 100,
+		}},
+		registers: map[sunspec.Point]uint16{
+			{Model: nameplateModel, Point: nameplatePointWRtg}:   rated,
+			{Model: nameplateModel, Point: nameplatePointWRtgSF}: 0,
+			// percent with 1 decimal
+			{Model: controlsModel, Point: controlsPointWMaxLimPctSF}: uint16(0xFFFF),
+		},
+	}
+}
+
+func (c *controlsPointReader) GetAnyPoint(ps ...sunspec.Point) (float64, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, p := range ps {
+		v, ok := c.registers[sunspec.Point{Model: p.Model, Point: p.Point}]
+		if !ok {
+			continue
+		}
+		if _, signed := p.T.(int16); signed {
+			return float64(int16(v)), nil
+		}
+		return float64(v), nil
+	}
+
+	return c.dummyPointReader.GetAnyPoint(ps...)
+}
+
+func (c *controlsPointReader) WritePoint(model, point uint16, values ...uint16) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if model != controlsModel {
+		return sunspec.ErrPointNotImplemented
+	}
+	for i, v := range values {
+		c.registers[sunspec.Point{Model: model, Point: point + uint16(i)}] = v
+	}
+	return nil
+}
+
+func (c *controlsPointReader) register(point uint16) uint16 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.registers[sunspec.Point{Model: controlsModel, Point: point}]
+}
+
+func TestPlant_LimitPV(t *testing.T) {
+	t.Parallel()
+
+	inv1, inv2 := newControlsPointReader(5000), newControlsPointReader(5000)
+	p, err := NewPlant(nil,
+		Device{Address: "inv1", Reader: inv1, LimitPower: true},
+		Device{Address: "inv2", Reader: inv2, LimitPower: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.LimitPV(context.Background(), "", 70, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inv := range []*controlsPointReader{inv1, inv2} {
+		expected := map[uint16]uint16{
+			controlsPointWMaxLimPct: 700,
+			controlsPointRvrtTms:    600,
+			controlsPointWMaxLimEna: 1,
+		}
+		for point, v := range expected {
+			if r := inv.register(point); r != v {
+				t.Fatalf("expected %v at point %v, got %v", v, point, r)
+			}
+		}
+	}
+
+	err = p.RemovePVLimit(context.Background(), "inv2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv1.register(controlsPointWMaxLimEna) != 1 || inv2.register(controlsPointWMaxLimEna) != 0 {
+		t.Fatal("expected only the limit of inv2 to be removed")
+	}
+}
+
+func TestPlant_LimitPV_invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		addr    string
+		pct     float64
+		timeout time.Duration
+		exErr   error
+	}{
+		{name: "NegativeLimit", pct: -1, exErr: ErrInvalidSetpoint},
+		{name: "LimitAbove100", pct: 101, exErr: ErrInvalidSetpoint},
+		{name: "TimeoutTooLong", pct: 50, timeout: 24 * time.Hour, exErr: ErrInvalidSetpoint},
+		{name: "NotLimitable", addr: "unlimited", pct: 50, exErr: ErrNotControllable},
+		{name: "UnknownInverter", addr: "unknown", pct: 50, exErr: ErrDeviceNotFound},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			inv := newControlsPointReader(5000)
+			p, err := NewPlant(nil,
+				Device{Address: "inv", Reader: inv, LimitPower: true},
+				Device{Address: "unlimited", Reader: newControlsPointReader(5000)},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = p.LimitPV(context.Background(), tt.addr, tt.pct, tt.timeout)
+			if !errors.Is(err, tt.exErr) {
+				t.Fatalf("expected %v, got %v", tt.exErr, err)
+			}
+
+			if r := inv.register(controlsPointWMaxLimEna); r != 0 {
+				t.Fatal("expected no limit")
+			}
+		})
+	}
+}
+
+func TestExportController_target(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		limit   float64
+		current float64
+		pv      float64
+		export  float64
+		ex      float64
+	}{
+		{name: "ExportAboveLimit", limit: 0, current: -1, pv: 6000, export: 2000, ex: 40},
+		{name: "ExportBelowLimit", limit: 1000, current: -1, pv: 2000, export: 0, ex: 30},
+		{name: "Import", limit: 0, current: -1, pv: 8000, export: -5000, ex: 100},
+		{name: "NoPowerLeft", limit: 0, current: -1, pv: 1000, export: 2000, ex: 0},
+		{name: "ReductionAtOnce", limit: 0, current: 80, pv: 5000, export: 1000, ex: 40},
+		{name: "IncreaseHalfway", limit: 0, current: 40, pv: 4000, export: -2000, ex: 50},
+		{name: "IncreaseToFullPower", limit: 0, current: 99, pv: 9900, export: -1000, ex: 100},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &exportController{limit: tt.limit, pct: tt.current}
+			if pct := c.target(tt.pv, tt.export, 10000); pct != tt.ex {
+				t.Fatalf("expected %v%%, got %v%%", tt.ex, pct)
+			}
+		})
+	}
+}
+
+type dummySubscriber chan Summary
+
+func (d dummySubscriber) Subscribe() (<-chan Summary, func()) {
+	return d, func() {}
+}
+
+// waitForRegisters fails the test if the registers of the immediate controls model don't have the values within a
+// second.
+func waitForRegisters(t *testing.T, inv *controlsPointReader, expected map[uint16]uint16) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		matching := true
+		for k, v := range expected {
+			if inv.register(k) != v {
+				matching = false
+			}
+		}
+		if matching {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected registers %v, got limit %v and revert timeout %v", expected,
+				inv.register(controlsPointWMaxLimPct), inv.register(controlsPointRvrtTms))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestControlExport(t *testing.T) {
+	t.Parallel()
+
+	inv := newControlsPointReader(10000)
+	p, err := NewPlant(nil, Device{Address: "inv", Reader: inv, LimitPower: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := make(dummySubscriber)
+	err = ControlExport(ctx, p, sub, 500, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.LimitPV(context.Background(), "", 50, 0)
+	if !errors.Is(err, ErrExportControlled) {
+		t.Fatalf("expected manual limit to fail, got %v", err)
+	}
+
+	// exporting 2500 W of 6000 W PV, limited to 40% with a revert timeout of 10s
+	sub <- Summary{HasGrid: true, PV: 6000, Grid: -2500}
+	waitForRegisters(t, inv, map[uint16]uint16{controlsPointWMaxLimPct: 400, controlsPointRvrtTms: 10})
+
+	// the revert timeout is restarted even if the limit doesn't change
+	err = inv.WritePoint(controlsModel, controlsPointRvrtTms, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub <- Summary{HasGrid: true, PV: 4000, Grid: -500}
+	waitForRegisters(t, inv, map[uint16]uint16{controlsPointWMaxLimPct: 400, controlsPointRvrtTms: 10})
+
+	// the export is unknown, so the PV power is limited to the export limit without revert timeout
+	sub <- Summary{HasGrid: true, PV: 4000, Grid: -500, Stale: true}
+	waitForRegisters(t, inv, map[uint16]uint16{controlsPointWMaxLimPct: 50, controlsPointRvrtTms: 0})
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for p.LimitPV(context.Background(), "", 50, 0) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected manual limits after the controller stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestControlExport_noSummaries(t *testing.T) {
+	t.Parallel()
+
+	inv := newControlsPointReader(10000)
+	p, err := NewPlant(nil, Device{Address: "inv", Reader: inv, LimitPower: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := &exportController{p: p, limit: 500, pct: -1, revert: 10 * time.Second, fallbackAfter: 50 * time.Millisecond}
+	summaries := make(chan Summary)
+	go c.run(ctx, summaries, func() {})
+
+	summaries <- Summary{HasGrid: true, PV: 6000, Grid: -2500}
+	waitForRegisters(t, inv, map[uint16]uint16{controlsPointWMaxLimPct: 400, controlsPointRvrtTms: 10})
+
+	// the meter goes offline, so the summaries stop
+	waitForRegisters(t, inv, map[uint16]uint16{controlsPointWMaxLimPct: 50, controlsPointRvrtTms: 0})
+}
@@ -0,0 +1,185 @@
+package plant
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// meterModels are the SunSpec meter models, which all share the same points.
+var meterModels = [...]uint16{201, 202, 203, 204}
+
+// points of the SunSpec meter models, phase values are followed by the values of phase B and C.
+// Scale factors aren't adjacent to their values, so they are read separately.
+const (
+	meterPointCurrentA      = 3
+	meterPointCurrentSF     = 6
+	meterPointVoltageA      = 8
+	meterPointVoltageSF     = 15
+	meterPointPower         = 18
+	meterPointPowerA        = 19
+	meterPointPowerSF       = 22
+	meterPointPowerFactorA  = 34
+	meterPointPowerFactorSF = 37
+	meterPointEnergyExport  = 38
+	meterPointEnergyImport  = 46
+	meterPointEnergySF      = 54
+)
+
+// meterPhases is the number of phases measured by SunSpec meters.
+const meterPhases = 3
+
+// meterPowerPoints returns the total power point of each meter model.
+func meterPowerPoints() []sunspec.Point {
+	ps := make([]sunspec.Point, len(meterModels))
+	for i, model := range meterModels {
+		ps[i] = sunspec.Point{Model: model, Point: meterPointPower, T: int16(0)}
+	}
+	return ps
+}
+
+// sunspecMeter reads the grid measurements from a SunSpec meter of models 201 to 204.
+type sunspecMeter struct {
+	mr    PointReader
+	addr  string
+	model uint16
+
+	m            sync.Mutex
+	lastPower    float32
+	lastReadTime time.Time
+	lastErr      error
+}
+
+// meterModel returns the SunSpec meter model implemented by the device.
+func meterModel(addr string, r PointReader) (uint16, error) {
+	ok, p, err := r.HasAnyPoint(meterPowerPoints()...)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("device %v is not a SunSpec meter", addr)
+	}
+
+	return p.Model, nil
+}
+
+func (s *sunspecMeter) ReadGrid(ctx context.Context) (GridReading, error) {
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+	reading, err := s.readGrid(ctx)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.lastErr = err
+	if err != nil {
+		return GridReading{}, errors.Wrap(err, fmt.Sprintf("reading meter %v", s.addr))
+	}
+
+	s.lastPower = reading.Power
+	s.lastReadTime = time.Now()
+	return reading, nil
+}
+
+func (s *sunspecMeter) readGrid(ctx context.Context) (GridReading, error) {
+	power, err := s.readScaled(ctx, meterPointPower, meterPointPowerSF, int16(0))
+	if err != nil {
+		return GridReading{}, err
+	}
+
+	// positive values are imported from the grid, same as the energy meter
+	reading := GridReading{Power: float32(power)}
+
+	// energy counters and phases are optional, the power is still valid without them
+	imp, err := s.readOptional(ctx, meterPointEnergyImport, meterPointEnergySF, uint32(0))
+	if err != nil {
+		return GridReading{}, err
+	}
+	exp, err := s.readOptional(ctx, meterPointEnergyExport, meterPointEnergySF, uint32(0))
+	if err != nil {
+		return GridReading{}, err
+	}
+	if imp != 0 || exp != 0 {
+		reading.ImportEnergy = imp
+		reading.ExportEnergy = exp
+	}
+
+	reading.Phases, err = s.readPhases(ctx)
+	if err != nil {
+		return GridReading{}, err
+	}
+
+	return reading, nil
+}
+
+// readPhases reads the measurements of all phases.
+//
+// Returns nil if the power of any phase is not implemented. Voltage, current and power factor are 0 if not
+// implemented.
+func (s *sunspecMeter) readPhases(ctx context.Context) ([]Phase, error) {
+	phases := make([]Phase, meterPhases)
+
+	for i := uint16(0); i < meterPhases; i++ {
+		power, err := s.readScaled(ctx, meterPointPowerA+i, meterPointPowerSF, int16(0))
+		if errors.Is(err, sunspec.ErrPointNotImplemented) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		voltage, err := s.readOptional(ctx, meterPointVoltageA+i, meterPointVoltageSF, int16(0))
+		if err != nil {
+			return nil, err
+		}
+		current, err := s.readOptional(ctx, meterPointCurrentA+i, meterPointCurrentSF, int16(0))
+		if err != nil {
+			return nil, err
+		}
+		// the power factor is in percent
+		powerFactor, err := s.readOptional(ctx, meterPointPowerFactorA+i, meterPointPowerFactorSF, int16(0))
+		if err != nil {
+			return nil, err
+		}
+
+		phases[i] = Phase{
+			Power:       float32(power),
+			Voltage:     float32(voltage),
+			Current:     float32(current),
+			PowerFactor: float32(powerFactor / 100),
+		}
+	}
+
+	return phases, nil
+}
+
+// readScaled reads the point of type t and applies the scale factor read from point sf.
+func (s *sunspecMeter) readScaled(ctx context.Context, point, sf uint16, t interface{}) (float64, error) {
+	return readScaled(ctx, s.mr, s.model, point, sf, t)
+}
+
+// readOptional reads a scaled point like readScaled, but returns 0 if the point is not implemented.
+func (s *sunspecMeter) readOptional(ctx context.Context, point, sf uint16, t interface{}) (float64, error) {
+	v, err := s.readScaled(ctx, point, sf, t)
+	if errors.Is(err, sunspec.ErrPointNotImplemented) {
+		return 0, nil
+	}
+	return v, err
+}
+
+func (s *sunspecMeter) deviceSummary() DeviceSummary {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return DeviceSummary{
+		Address:    s.addr,
+		Type:       DeviceTypeMeter,
+		Power:      s.lastPower,
+		LastRead:   s.lastReadTime,
+		Err:        s.lastErr,
+		Connection: connStateOf(s.mr),
+	}
+}
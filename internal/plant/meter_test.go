@@ -0,0 +1,157 @@
+package plant
+
+import (
+	"context"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"reflect"
+	"testing"
+)
+
+func meterPoint(point uint16, t interface{}) sunspec.Point {
+	return sunspec.Point{Model: 203, Point: point, T: t}
+}
+
+func TestSunSpecMeter_ReadGrid(t *testing.T) {
+	t.Parallel()
+
+	total := map[sunspec.Point]float64{
+		meterPoint(meterPointPower, int16(0)):   15204,
+		meterPoint(meterPointPowerSF, int16(0)): -1,
+	}
+
+	full := map[sunspec.Point]float64{
+		meterPoint(meterPointEnergyImport, uint32(0)): 2107,
+		meterPoint(meterPointEnergyExport, uint32(0)): 3212,
+		meterPoint(meterPointEnergySF, int16(0)):      3,
+		meterPoint(meterPointVoltageSF, int16(0)):     -1,
+		meterPoint(meterPointCurrentSF, int16(0)):     -2,
+		meterPoint(meterPointPowerFactorSF, int16(0)): 0,
+	}
+	for k, v := range total {
+		full[k] = v
+	}
+	for i, power := range []float64{5000, 6000, 4204} {
+		full[meterPoint(meterPointPowerA+uint16(i), int16(0))] = power
+		full[meterPoint(meterPointVoltageA+uint16(i), int16(0))] = 2301
+		full[meterPoint(meterPointCurrentA+uint16(i), int16(0))] = 250
+		full[meterPoint(meterPointPowerFactorA+uint16(i), int16(0))] = 95
+	}
+
+	tests := []struct {
+		name      string
+		points    map[sunspec.Point]float64
+		exReading GridReading
+		exErr     bool
+	}{
+		{
+			name:      "TotalOnly",
+			points:    total,
+			exReading: GridReading{Power: 1520.4},
+		},
+		{
+			name:   "Full",
+			points: full,
+			exReading: GridReading{
+				Power:        1520.4,
+				ImportEnergy: 2107000,
+				ExportEnergy: 3212000,
+				Phases: []Phase{
+					{Power: 500, Voltage: 230.1, Current: 2.5, PowerFactor: 0.95},
+					{Power: 600, Voltage: 230.1, Current: 2.5, PowerFactor: 0.95},
+					{Power: 420.4, Voltage: 230.1, Current: 2.5, PowerFactor: 0.95},
+				},
+			},
+		},
+		{
+			name:   "NoPower",
+			points: map[sunspec.Point]float64{meterPoint(meterPointPowerSF, int16(0)): -1},
+			exErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m := &sunspecMeter{mr: &dummyPointReader{points: tt.points}, addr: "meter", model: 203}
+			reading, err := m.ReadGrid(context.Background())
+			if tt.exErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(reading, tt.exReading) {
+				t.Fatalf("expected %+v, got %+v", tt.exReading, reading)
+			}
+		})
+	}
+}
+
+func TestNewPlant_sunspecMeter(t *testing.T) {
+	t.Parallel()
+
+	devices := []Device{
+		{Address: "inverter", Reader: &dummyPointReader{points: map[sunspec.Point]float64{sunspec.PointPower1Phase: 300}}},
+		{Address: "meter", Reader: &dummyPointReader{points: map[sunspec.Point]float64{
+			meterPoint(meterPointPower, int16(0)):   -100,
+			meterPoint(meterPointPowerSF, int16(0)): 0,
+		}}},
+	}
+
+	plant, err := NewPlant(nil, devices...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := plant.FetchSummary(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Summary{
+		Grid:            -100,
+		PV:              300,
+		SelfConsumption: 200,
+		HasGrid:         true,
+		Devices: []DeviceSummary{
+			{Address: "inverter", Type: DeviceTypePV, Power: 300},
+			{Address: "meter", Type: DeviceTypeMeter, Power: -100},
+		},
+	}
+	if !equalSummaryButTime(expected, summary) {
+		t.Fatalf("expected %v, got %v", expected, summary)
+	}
+
+	// the energy meter takes precedence
+	em := &dummyEnergyMeter{grid: 50}
+	plant, err = NewPlant(em, devices...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plant.Meter != em {
+		t.Fatalf("expected energy meter, got %v", plant.Meter)
+	}
+
+	// the unused SunSpec meter is still listed
+	summary, err = plant.FetchSummary(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exDevices := []DeviceSummary{
+		{Address: "inverter", Type: DeviceTypePV, Power: 300},
+		{Address: "meter", Type: DeviceTypeMeter, Unused: true},
+	}
+	if !equalSummaryButTime(Summary{Grid: 50, PV: 300, SelfConsumption: 350, HasGrid: true, Devices: exDevices},
+		summary) {
+		t.Fatalf("expected devices %v, got %v", exDevices, summary.Devices)
+	}
+	if d := plant.Devices()[1]; d.Type != DeviceTypeMeter || !d.Unused {
+		t.Fatalf("expected unused meter, got %+v", d)
+	}
+}
@@ -6,32 +6,93 @@ import (
 	"github.com/orlopau/go-energy/pkg/sunspec"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
+	"log"
+	"math"
 	"sync"
 	"time"
 )
 
 type powerReader interface {
-	ReadPower() (float32, error)
+	ReadPower(ctx context.Context) (float32, error)
 }
 
 type batteryReader interface {
 	powerReader
-	ReadSoC() (uint, error)
+	ReadSoC(ctx context.Context) (uint, error)
+	// Capacity returns the usable capacity in Wh, 0 if unknown.
+	Capacity() float64
 }
 
-type gridReader interface {
-	ReadGrid() (float32, error)
+// deviceReporter is implemented by readers reporting the values of a single device.
+type deviceReporter interface {
+	deviceSummary() DeviceSummary
+}
+
+// GridReader reads the measurements at the grid connection point of a plant.
+type GridReader interface {
+	ReadGrid(ctx context.Context) (GridReading, error)
+}
+
+// Fetcher fetches summaries of a plant.
+type Fetcher interface {
+	FetchSummary(ctx context.Context) (Summary, error)
+}
+
+// Subscriber provides new summaries of a plant.
+type Subscriber interface {
+	Subscribe() (<-chan Summary, func())
 }
 
 type Plant struct {
 	Inverters []powerReader
-	Bat       batteryReader
-	Meter     gridReader
+	Bats      []batteryReader
+	// Meter is nil if the grid power of the plant is unknown.
+	Meter GridReader
+
+	// m guards the fields above against devices being added while fetching.
+	m sync.RWMutex
+	// devices contains all devices of the plant, devices without a type are pending.
+	devices []Device
+	// types contains the type of each added device by address.
+	types map[string]int
+	// identities contains the identity of each added device by address.
+	identities map[string]Identity
+	// unused contains the addresses of added devices which aren't read, e.g. SunSpec meters besides an energy meter.
+	unused map[string]bool
+	// exportControlled is set while the export controller limits the PV inverters.
+	exportControlled bool
 }
 
 type ContinuousFetchPlant struct {
+	gracePeriod time.Duration
+	staleAfter  time.Duration
+
+	m           sync.Mutex
 	lastSummary Summary
+	// lastSuccess is the time of the last successful fetch, zero if there was none.
+	lastSuccess time.Time
 	lastError   error
+	errorSince  time.Time
+
+	broadcaster broadcaster
+}
+
+// FetchOption configures a ContinuousFetchPlant.
+type FetchOption func(*ContinuousFetchPlant)
+
+// WithGracePeriod keeps serving the last summary for the duration after fetches started failing, instead of
+// returning the error immediately.
+func WithGracePeriod(d time.Duration) FetchOption {
+	return func(c *ContinuousFetchPlant) {
+		c.gracePeriod = d
+	}
+}
+
+// WithStaleAfter marks summaries older than the duration as stale.
+func WithStaleAfter(d time.Duration) FetchOption {
+	return func(c *ContinuousFetchPlant) {
+		c.staleAfter = d
+	}
 }
 
 type Summary struct {
@@ -40,41 +101,148 @@ type Summary struct {
 	SelfConsumption              float32
 	BatPercentage                uint
 	TimestampStart, TimestampEnd time.Time
+	// GridImportEnergy and GridExportEnergy are the readings of the grid meter in Wh, 0 if not available.
+	GridImportEnergy, GridExportEnergy float64
+	// GridPhases contains the measurements of each phase at the grid connection point, nil if not available.
+	GridPhases []Phase
+	// Devices contains the values of each device of the plant.
+	Devices []DeviceSummary
+	// HasBattery is false if the plant has no battery inverters, Bat and BatPercentage are 0 then.
+	HasBattery bool
+	// HasGrid is false if the plant has no grid meter, Grid and SelfConsumption are 0 then.
+	HasGrid bool
+	// Age is the time since the summary was fetched, only set by a ContinuousFetchPlant. Summaries of its subscribers
+	// are as old as their fetch took.
+	Age time.Duration
+	// Stale is true if Age exceeds the staleness threshold of the ContinuousFetchPlant.
+	Stale bool
 }
 
-func NewPlant(em gridReader, readers ...PointReader) (*Plant, error) {
-	var (
-		pvs []powerReader
-		bat *batteryInverter
-	)
+// NewPlant creates a plant of the devices.
+//
+// If em is nil, a SunSpec meter among the devices is used as grid meter instead. Without either, the grid power of the
+// plant is unknown. SunSpec meters are unused if em is set, but still listed.
+//
+// Supervised devices are connected in the background and added to the plant once their type is detected. They are
+// pending until then, devices which can't be connected stay pending until they come online.
+func NewPlant(em GridReader, devices ...Device) (*Plant, error) {
+	if em == nil && len(devices) == 0 {
+		return nil, fmt.Errorf("plant has neither a grid meter nor devices")
+	}
+
+	p := &Plant{
+		Meter:      em,
+		devices:    devices,
+		types:      make(map[string]int),
+		identities: make(map[string]Identity),
+		unused:     make(map[string]bool),
+	}
 
-	for _, r := range readers {
-		t, err := getDeviceType(r)
+	for _, d := range devices {
+		if s, ok := d.Reader.(*SupervisedReader); ok {
+			s.start(p.detect(d))
+			continue
+		}
+
+		err := p.detect(d)(d.Reader)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	return p, nil
+}
+
+// detect returns a function detecting the type and identity of the device using a connection to it and adding it to
+// the plant.
+//
+// After the device was added, the function only checks that the type of the device didn't change.
+func (p *Plant) detect(d Device) func(PointReader) error {
+	return func(r PointReader) error {
+		t, err := getDeviceType(r)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("detecting type of device %v", d.Address))
+		}
 
-		switch t {
-		case deviceBatteryInverter:
-			if bat != nil {
-				return nil, fmt.Errorf("multiple battery inverters in plant")
+		// the identity is read again on each connection, the firmware may have been updated
+		if sr, ok := r.(stringReader); ok {
+			id, err := readIdentity(sr)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("reading identity of device %v", d.Address))
 			}
-			bat = &batteryInverter{inverter: inverter{mr: r}}
-		case devicePVInverter:
-			pvs = append(pvs, &inverter{mr: r})
-		default:
-			return nil, fmt.Errorf("unknown device type")
+
+			p.m.Lock()
+			p.identities[d.Address] = id
+			p.m.Unlock()
 		}
+
+		var model uint16
+		if t == deviceMeter {
+			model, err = meterModel(d.Address, r)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("setting up meter %v", d.Address))
+			}
+		}
+
+		return p.add(d, t, model)
+	}
+}
+
+// add adds the device of type t to the plant, model is the SunSpec model of meters. If the device was already added,
+// add returns an error if its type changed.
+func (p *Plant) add(d Device, t int, model uint16) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if prev, ok := p.types[d.Address]; ok {
+		if prev != t {
+			return fmt.Errorf("type of device %v changed from %v to %v", d.Address, prev, t)
+		}
+		return nil
+	}
+
+	switch t {
+	case deviceBatteryInverter:
+		b := &batteryInverter{
+			inverter: inverter{mr: d.Reader, addr: d.Address},
+			capacity: d.Capacity,
+		}
+		if d.Limits != nil {
+			b.control = &batteryController{addr: d.Address, mr: d.Reader, limits: *d.Limits}
+		}
+		p.Bats = append(p.Bats, b)
+	case devicePVInverter:
+		inv := &inverter{mr: d.Reader, addr: d.Address}
+		if d.LimitPower {
+			inv.limiter = &powerLimiter{addr: d.Address, mr: d.Reader}
+		}
+		p.Inverters = append(p.Inverters, inv)
+	case deviceMeter:
+		if _, ok := p.Meter.(*sunspecMeter); ok {
+			return fmt.Errorf("multiple meters in plant")
+		}
+		// the energy meter takes precedence
+		if p.Meter != nil {
+			log.Printf("not using SunSpec meter %v, the grid power is read from the energy meter", d.Address)
+			p.unused[d.Address] = true
+			break
+		}
+		p.Meter = &sunspecMeter{mr: d.Reader, addr: d.Address, model: model}
+	default:
+		return fmt.Errorf("unknown device type")
 	}
 
-	return &Plant{
-		Inverters: pvs,
-		Bat:       bat,
-		Meter:     em,
-	}, nil
+	p.types[d.Address] = t
+	return nil
 }
 
-func fetchSum(readers ...powerReader) (float32, error) {
+// fetchSum returns the sum of the power of all readers. Disconnected devices are left out, their errors are only
+// reported in their device summaries.
+func fetchSum(ctx context.Context, readers ...powerReader) (float32, error) {
+	if len(readers) == 0 {
+		return 0, nil
+	}
+
 	powc := make(chan float32)
 	errc := make(chan error)
 
@@ -85,14 +253,20 @@ func fetchSum(readers ...powerReader) (float32, error) {
 
 	for _, v := range readers {
 		go func(reader powerReader) {
-			power, err := reader.ReadPower()
+			power, err := reader.ReadPower(ctx)
+			if err != nil && disconnected(reader) {
+				power, err = 0, nil
+			}
 			if err != nil && !errors.Is(err, sunspec.ErrPointNotImplemented) {
 				select {
 				case errc <- err:
 				case <-quitc:
 				}
 			} else {
-				powc <- power
+				select {
+				case powc <- power:
+				case <-quitc:
+				}
 			}
 		}(v)
 	}
@@ -116,16 +290,92 @@ func fetchSum(readers ...powerReader) (float32, error) {
 	}
 }
 
-func (p *Plant) FetchSummary() (Summary, error) {
+// fetchSoC returns the aggregated SoC of all batteries, weighted by their capacity.
+//
+// If the capacity of any battery is unknown, all batteries are weighted equally. Disconnected batteries are left out,
+// false is returned if all batteries are disconnected.
+func fetchSoC(ctx context.Context, bats ...batteryReader) (uint, bool, error) {
+	var g errgroup.Group
+	socs := make([]uint, len(bats))
+	read := make([]bool, len(bats))
+
+	for i, v := range bats {
+		i, bat := i, v
+		g.Go(func() error {
+			soc, err := bat.ReadSoC(ctx)
+			if err != nil && disconnected(bat) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			socs[i], read[i] = soc, true
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var connected []batteryReader
+	var connectedSoCs []uint
+	for i, v := range bats {
+		if read[i] {
+			connected = append(connected, v)
+			connectedSoCs = append(connectedSoCs, socs[i])
+		}
+	}
+	if len(connected) == 0 {
+		return 0, false, nil
+	}
+	bats, socs = connected, connectedSoCs
+
+	var weighted, total float64
+	for i, v := range bats {
+		capacity := v.Capacity()
+		if capacity <= 0 {
+			weighted, total = 0, 0
+			break
+		}
+		weighted += float64(socs[i]) * capacity
+		total += capacity
+	}
+
+	// fall back to equal weights
+	if total == 0 {
+		for _, soc := range socs {
+			weighted += float64(soc)
+		}
+		total = float64(len(socs))
+	}
+
+	return uint(math.Round(weighted / total)), true, nil
+}
+
+// FetchSummary reads all devices of the plant. It returns the error of the context if it is done before all devices
+// are read.
+func (p *Plant) FetchSummary(ctx context.Context) (Summary, error) {
 	var summary Summary
 	var m sync.Mutex
 
-	// wait for EM message
-	grid, err := p.Meter.ReadGrid()
-	if err != nil {
-		return Summary{}, err
+	p.m.RLock()
+	inverters, bats, meter := p.Inverters, p.Bats, p.Meter
+	p.m.RUnlock()
+
+	if meter != nil {
+		// wait for EM message
+		grid, err := meter.ReadGrid(ctx)
+		if err != nil {
+			return Summary{}, err
+		}
+		summary.HasGrid = true
+		summary.Grid = grid.Power
+		summary.GridImportEnergy = grid.ImportEnergy
+		summary.GridExportEnergy = grid.ExportEnergy
+		summary.GridPhases = grid.Phases
 	}
-	summary.Grid = grid
 	summary.TimestampStart = time.Now()
 
 	// fetch SunSpec data
@@ -133,7 +383,7 @@ func (p *Plant) FetchSummary() (Summary, error) {
 
 	// fetch PV wattage
 	g.Go(func() error {
-		pv, err := fetchSum(p.Inverters...)
+		pv, err := fetchSum(ctx, inverters...)
 		if err != nil {
 			return err
 		}
@@ -146,7 +396,16 @@ func (p *Plant) FetchSummary() (Summary, error) {
 
 	// fetch battery wattage
 	g.Go(func() error {
-		power, err := p.Bat.ReadPower()
+		if len(bats) == 0 {
+			return nil
+		}
+
+		readers := make([]powerReader, len(bats))
+		for i, v := range bats {
+			readers[i] = v
+		}
+
+		power, err := fetchSum(ctx, readers...)
 		if err != nil {
 			return err
 		}
@@ -159,52 +418,127 @@ func (p *Plant) FetchSummary() (Summary, error) {
 
 	// fetch battery soc
 	g.Go(func() error {
-		if p.Bat == nil {
+		if len(bats) == 0 {
 			return nil
 		}
 
-		soc, err := p.Bat.ReadSoC()
+		soc, ok, err := fetchSoC(ctx, bats...)
 		if err != nil {
 			return err
 		}
 
 		m.Lock()
 		summary.BatPercentage = soc
+		summary.HasBattery = ok
 		m.Unlock()
 		return nil
 	})
 
-	err = g.Wait()
+	err := g.Wait()
 	if err != nil {
 		return Summary{}, err
 	}
 
-	summary.SelfConsumption = summary.PV + summary.Bat + summary.Grid
+	if summary.HasGrid {
+		summary.SelfConsumption = summary.PV + summary.Bat + summary.Grid
+	}
+	summary.Devices = p.deviceSummaries()
 	summary.TimestampEnd = time.Now()
 
 	return summary, nil
 }
 
-func FetchContinuously(ctx context.Context, plant *Plant) *ContinuousFetchPlant {
-	cfp := &ContinuousFetchPlant{}
-	cfp.lastError = fmt.Errorf("no data")
+func (p *Plant) deviceSummaries() []DeviceSummary {
+	var devices []DeviceSummary
+
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	for _, v := range p.Inverters {
+		if r, ok := v.(deviceReporter); ok {
+			devices = append(devices, r.deviceSummary())
+		}
+	}
+
+	for _, v := range p.Bats {
+		if r, ok := v.(deviceReporter); ok {
+			devices = append(devices, r.deviceSummary())
+		}
+	}
+
+	if r, ok := p.Meter.(deviceReporter); ok {
+		devices = append(devices, r.deviceSummary())
+	}
+
+	for _, v := range p.devices {
+		if p.unused[v.Address] {
+			devices = append(devices, DeviceSummary{
+				Address:    v.Address,
+				Type:       deviceTypeName(p.types[v.Address]),
+				Unused:     true,
+				Connection: connStateOf(v.Reader),
+			})
+			continue
+		}
+		if _, ok := p.types[v.Address]; ok {
+			continue
+		}
+
+		state := connStateOf(v.Reader)
+		devices = append(devices, DeviceSummary{
+			Address:    v.Address,
+			Type:       DeviceTypeUnknown,
+			Capacity:   v.Capacity,
+			Err:        state.Err,
+			Connection: state,
+		})
+	}
+
+	return devices
+}
+
+// FetchContinuously fetches summaries of the plant until the context is cancelled.
+//
+// interval is the minimum time between the start of two fetches. Plants with an energy meter are paced by its
+// telegrams and may use an interval of 0, plants without one need an interval to not fetch back to back.
+// After a failed fetch, the next fetch is delayed by at least retryDelay.
+//
+// Summaries are stale after 3 intervals, but at least after defaultStaleAfter, unless configured otherwise.
+func FetchContinuously(ctx context.Context, plant Fetcher, interval time.Duration,
+	opts ...FetchOption) *ContinuousFetchPlant {
+	cfp := &ContinuousFetchPlant{staleAfter: defaultStaleAfter}
+	if 3*interval > cfp.staleAfter {
+		cfp.staleAfter = 3 * interval
+	}
+	for _, opt := range opts {
+		opt(cfp)
+	}
+
+	cfp.errorSince = time.Now()
+	cfp.lastError = &FetchError{Err: ErrNoData, Since: cfp.errorSince}
 
 	go func() {
 		for {
-			s, err := plant.FetchSummary()
-			if err != nil {
-				cfp.lastError = err
-				cfp.lastSummary = Summary{}
-				continue
-			}
+			start := time.Now()
+			wait := interval
 
-			cfp.lastSummary = s
-			cfp.lastError = nil
+			s, err := plant.FetchSummary(ctx)
+			if err != nil && wait < retryDelay {
+				wait = retryDelay
+			}
+			end := time.Now()
+			cfp.record(s, err, end)
+			if err == nil {
+				// the values may have been read at the start of a slow fetch
+				s.Age = end.Sub(start)
+				s.Stale = s.Age > cfp.staleAfter
+				cfp.broadcaster.publish(s)
+			}
 
 			select {
 			case <-ctx.Done():
 				return
-			default:
+			case <-time.After(wait - time.Since(start)):
 			}
 		}
 	}()
@@ -212,6 +546,55 @@ func FetchContinuously(ctx context.Context, plant *Plant) *ContinuousFetchPlant
 	return cfp
 }
 
+// record stores the result of a fetch which ended at now.
+func (c *ContinuousFetchPlant) record(s Summary, err error, now time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if err == nil {
+		c.lastSummary = s
+		c.lastSuccess = now
+		c.lastError = nil
+		return
+	}
+
+	if c.lastError == nil {
+		c.errorSince = now
+	}
+	c.lastError = &FetchError{Err: err, Since: c.errorSince}
+}
+
+// StaleAfter returns the age after which summaries of the plant are stale.
+func (c *ContinuousFetchPlant) StaleAfter() time.Duration {
+	return c.staleAfter
+}
+
+// FetchSummary returns the last summary of the plant.
+//
+// If the last fetch failed, the last successful summary is returned until the grace period after the fetches started
+// failing is over. Afterwards, a FetchError is returned.
 func (c *ContinuousFetchPlant) FetchSummary() (Summary, error) {
-	return c.lastSummary, c.lastError
+	return c.summaryAt(time.Now())
+}
+
+func (c *ContinuousFetchPlant) summaryAt(now time.Time) (Summary, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.lastError != nil && (c.lastSuccess.IsZero() || now.Sub(c.errorSince) >= c.gracePeriod) {
+		return Summary{}, c.lastError
+	}
+
+	s := c.lastSummary
+	s.Age = now.Sub(c.lastSuccess)
+	s.Stale = s.Age > c.staleAfter
+	return s, nil
+}
+
+// Subscribe returns a channel receiving every new summary of the plant.
+//
+// Only the latest summary is buffered, a slow subscriber misses intermediate summaries.
+// The returned function must be called to unsubscribe, which closes the channel.
+func (c *ContinuousFetchPlant) Subscribe() (<-chan Summary, func()) {
+	return c.broadcaster.subscribe()
 }
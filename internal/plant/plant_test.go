@@ -1,27 +1,39 @@
 package plant
 
 import (
+	"context"
 	"fmt"
 	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
 	"go.uber.org/goleak"
+	"net"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
 
 type dummyBatteryPowerReader struct {
-	isErr bool
-	power float32
-	soc   uint
+	isErr    bool
+	power    float32
+	soc      uint
+	capacity float64
+}
+
+func (r *dummyBatteryPowerReader) Capacity() float64 {
+	return r.capacity
 }
 
-func (r *dummyBatteryPowerReader) ReadSoC() (uint, error) {
+func (r *dummyBatteryPowerReader) ReadSoC(ctx context.Context) (uint, error) {
 	if r.isErr {
 		return 0, fmt.Errorf("dummy error soc")
 	}
 	return r.soc, nil
 }
 
-func (r *dummyBatteryPowerReader) ReadPower() (float32, error) {
+func (r *dummyBatteryPowerReader) ReadPower(ctx context.Context) (float32, error) {
 	if r.isErr {
 		return 0, fmt.Errorf("dummy error power")
 	}
@@ -33,11 +45,11 @@ type dummyEnergyMeter struct {
 	grid  float32
 }
 
-func (d *dummyEnergyMeter) ReadGrid() (float32, error) {
+func (d *dummyEnergyMeter) ReadGrid(ctx context.Context) (GridReading, error) {
 	if d.isErr {
-		return 0, fmt.Errorf("dummy error meter")
+		return GridReading{}, fmt.Errorf("dummy error meter")
 	}
-	return d.grid, nil
+	return GridReading{Power: d.grid}, nil
 }
 
 func TestMain(m *testing.M) {
@@ -59,7 +71,7 @@ func Test_fetchSum(t *testing.T) {
 		},
 	}
 
-	sum, err := fetchSum(powerReaders...)
+	sum, err := fetchSum(context.Background(), powerReaders...)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -69,6 +81,19 @@ func Test_fetchSum(t *testing.T) {
 	}
 }
 
+func Test_fetchSum_noReaders(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	sum, err := fetchSum(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sum != 0 {
+		t.Fatalf("expected sum of 0, got %v", sum)
+	}
+}
+
 func Test_fetchSum_err(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -86,7 +111,7 @@ func Test_fetchSum_err(t *testing.T) {
 		},
 	}
 
-	_, err := fetchSum(powerReaders...)
+	_, err := fetchSum(context.Background(), powerReaders...)
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -118,21 +143,23 @@ func TestPlant_FetchSummary(t *testing.T) {
 
 	plant := Plant{
 		Inverters: powerReaders,
-		Bat:       &batReader,
+		Bats:      []batteryReader{&batReader},
 		Meter:     &energyMeter,
 	}
 
-	summary, err := plant.FetchSummary()
+	summary, err := plant.FetchSummary(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	expected := Summary{
 		Grid:            -500,
+		HasGrid:         true,
 		PV:              600,
 		Bat:             200,
 		SelfConsumption: 300,
 		BatPercentage:   60,
+		HasBattery:      true,
 	}
 
 	if !equalSummaryButTime(expected, summary) {
@@ -140,11 +167,206 @@ func TestPlant_FetchSummary(t *testing.T) {
 	}
 }
 
+func TestPlant_FetchSummary_noMeter(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	plant := Plant{
+		Inverters: []powerReader{&dummyBatteryPowerReader{power: 300}},
+	}
+
+	summary, err := plant.FetchSummary(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Summary{
+		PV: 300,
+	}
+
+	if !equalSummaryButTime(expected, summary) {
+		t.Fatalf("expected %v got %v", expected, summary)
+	}
+}
+
+type countingFetcher struct {
+	n int32
+}
+
+func (c *countingFetcher) FetchSummary(ctx context.Context) (Summary, error) {
+	atomic.AddInt32(&c.n, 1)
+	return Summary{}, nil
+}
+
+func TestFetchContinuously_interval(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &countingFetcher{}
+	FetchContinuously(ctx, f, 50*time.Millisecond)
+
+	time.Sleep(120 * time.Millisecond)
+	cancel()
+
+	// fetches at 0, 50 and 100ms
+	if n := atomic.LoadInt32(&f.n); n < 2 || n > 3 {
+		t.Fatalf("expected 2 to 3 fetches, got %v", n)
+	}
+}
+
+type failingFetcher struct {
+	n int32
+}
+
+func (f *failingFetcher) FetchSummary(ctx context.Context) (Summary, error) {
+	atomic.AddInt32(&f.n, 1)
+	return Summary{}, fmt.Errorf("dummy error")
+}
+
+func TestFetchContinuously_retryDelay(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &failingFetcher{}
+	cfp := FetchContinuously(ctx, f, 0)
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	// failed fetches are delayed instead of being retried immediately
+	if n := atomic.LoadInt32(&f.n); n != 1 {
+		t.Fatalf("expected a single fetch, got %v", n)
+	}
+	if _, err := cfp.FetchSummary(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestContinuousFetchPlant_summaryAt(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1608579000, 0)
+	summary := Summary{PV: 300}
+	fetchErr := fmt.Errorf("dummy error")
+
+	tests := []struct {
+		name    string
+		grace   time.Duration
+		failAt  time.Duration
+		readAt  time.Duration
+		exAge   time.Duration
+		exStale bool
+		exErr   bool
+	}{
+		{name: "Fresh", readAt: time.Second, exAge: time.Second},
+		{name: "Stale", readAt: 20 * time.Second, exAge: 20 * time.Second, exStale: true},
+		{name: "NoGracePeriod", failAt: time.Second, readAt: time.Second, exErr: true},
+		{name: "WithinGracePeriod", grace: 30 * time.Second, failAt: time.Second, readAt: 20 * time.Second,
+			exAge: 20 * time.Second, exStale: true},
+		{name: "AfterGracePeriod", grace: 30 * time.Second, failAt: time.Second, readAt: 31 * time.Second, exErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &ContinuousFetchPlant{gracePeriod: tt.grace, staleAfter: defaultStaleAfter}
+			c.record(summary, nil, start)
+			if tt.failAt != 0 {
+				c.record(Summary{}, fetchErr, start.Add(tt.failAt))
+				// the error persists since the first failed fetch
+				c.record(Summary{}, fetchErr, start.Add(tt.readAt))
+			}
+
+			s, err := c.summaryAt(start.Add(tt.readAt))
+			if tt.exErr {
+				var e *FetchError
+				if !errors.As(err, &e) || !e.Since.Equal(start.Add(tt.failAt)) {
+					t.Fatalf("expected fetch error since first failure, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s.PV != summary.PV || s.Age != tt.exAge || s.Stale != tt.exStale {
+				t.Fatalf("expected age %v and stale %v, got %+v", tt.exAge, tt.exStale, s)
+			}
+		})
+	}
+}
+
+type slowFetcher struct {
+	d time.Duration
+}
+
+func (s *slowFetcher) FetchSummary(ctx context.Context) (Summary, error) {
+	time.Sleep(s.d)
+	return Summary{PV: 100}, nil
+}
+
+func TestFetchContinuously_publishStale(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		d       time.Duration
+		exStale bool
+	}{
+		{name: "Fresh", d: time.Millisecond},
+		{name: "SlowFetch", d: 100 * time.Millisecond, exStale: true},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := FetchContinuously(ctx, &slowFetcher{d: tt.d}, 0, WithStaleAfter(50*time.Millisecond))
+		summaries, unsubscribe := c.Subscribe()
+
+		s := <-summaries
+		unsubscribe()
+		cancel()
+
+		if s.PV != 100 || s.Age < tt.d || s.Stale != tt.exStale {
+			t.Fatalf("%v: expected age of at least %v and stale %v, got %+v", tt.name, tt.d, tt.exStale, s)
+		}
+	}
+}
+
+func TestFetchContinuously_staleAfter(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		opts     []FetchOption
+		ex       time.Duration
+	}{
+		{name: "Default", interval: time.Second, ex: defaultStaleAfter},
+		{name: "LongInterval", interval: time.Minute, ex: 3 * time.Minute},
+		{name: "Configured", interval: time.Minute, opts: []FetchOption{WithStaleAfter(time.Second)}, ex: time.Second},
+	}
+
+	for _, tt := range tests {
+		if c := FetchContinuously(ctx, &countingFetcher{}, tt.interval, tt.opts...); c.staleAfter != tt.ex {
+			t.Fatalf("%v: expected stale after %v, got %v", tt.name, tt.ex, c.staleAfter)
+		}
+	}
+}
+
 type dummyPointReader struct {
 	points map[sunspec.Point]float64
+	err    error
 }
 
 func (d *dummyPointReader) GetAnyPoint(ps ...sunspec.Point) (float64, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+
 	for _, v := range ps {
 		r, ok := d.points[v]
 		if ok {
@@ -171,6 +393,7 @@ func TestNewPlant(t *testing.T) {
 	tests := []struct {
 		name          string
 		devicesPoints []map[sunspec.Point]float64
+		capacities    []float64
 		grid          float32
 		exNewErr      bool
 		exSummary     Summary
@@ -190,14 +413,63 @@ func TestNewPlant(t *testing.T) {
 			exNewErr: false,
 			exSummary: Summary{
 				Grid:            -50,
+				HasGrid:         true,
 				PV:              100,
 				Bat:             200,
 				SelfConsumption: 250,
 				BatPercentage:   50,
+				HasBattery:      true,
+				Devices: []DeviceSummary{
+					{Address: "device1", Type: DeviceTypePV, Power: 100},
+					{Address: "device0", Type: DeviceTypeBattery, Power: 200, SoC: 50},
+				},
 			},
 		},
 		{
-			name: "InvalidPlantMultipleInverters",
+			name: "PVOnly",
+			devicesPoints: []map[sunspec.Point]float64{
+				{
+					sunspec.PointPower1Phase: 100,
+				},
+				{
+					sunspec.PointPower3Phase: 200,
+				},
+			},
+			grid: 50,
+			exSummary: Summary{
+				Grid:            50,
+				HasGrid:         true,
+				PV:              300,
+				SelfConsumption: 350,
+				Devices: []DeviceSummary{
+					{Address: "device0", Type: DeviceTypePV, Power: 100},
+					{Address: "device1", Type: DeviceTypePV, Power: 200},
+				},
+			},
+		},
+		{
+			name: "BatteryOnly",
+			devicesPoints: []map[sunspec.Point]float64{
+				{
+					sunspec.PointPower1Phase: 200,
+					sunspec.PointSoc:         50,
+				},
+			},
+			grid: 50,
+			exSummary: Summary{
+				Grid:            50,
+				HasGrid:         true,
+				Bat:             200,
+				SelfConsumption: 250,
+				BatPercentage:   50,
+				HasBattery:      true,
+				Devices: []DeviceSummary{
+					{Address: "device0", Type: DeviceTypeBattery, Power: 200, SoC: 50},
+				},
+			},
+		},
+		{
+			name: "MultipleBatteriesEqualWeights",
 			devicesPoints: []map[sunspec.Point]float64{
 				{
 					sunspec.PointPower1Phase: 200,
@@ -205,11 +477,60 @@ func TestNewPlant(t *testing.T) {
 				},
 				{
 					sunspec.PointPower1Phase: 100,
-					sunspec.PointSoc: 20,
+					sunspec.PointSoc:         20,
+				},
+				{
+					sunspec.PointPower1Phase: 300,
+				},
+			},
+			capacities: []float64{10000, 0},
+			grid:       100,
+			exSummary: Summary{
+				Grid:            100,
+				HasGrid:         true,
+				PV:              300,
+				Bat:             300,
+				SelfConsumption: 700,
+				BatPercentage:   35,
+				HasBattery:      true,
+				Devices: []DeviceSummary{
+					{Address: "device2", Type: DeviceTypePV, Power: 300},
+					{Address: "device0", Type: DeviceTypeBattery, Power: 200, SoC: 50, Capacity: 10000},
+					{Address: "device1", Type: DeviceTypeBattery, Power: 100, SoC: 20},
+				},
+			},
+		},
+		{
+			name: "MultipleBatteriesCapacityWeights",
+			devicesPoints: []map[sunspec.Point]float64{
+				{
+					sunspec.PointPower1Phase: 200,
+					sunspec.PointSoc:         50,
+				},
+				{
+					sunspec.PointPower1Phase: -100,
+					sunspec.PointSoc:         20,
+				},
+				{
+					sunspec.PointPower1Phase: 300,
+				},
+			},
+			capacities: []float64{10000, 5000},
+			grid:       100,
+			exSummary: Summary{
+				Grid:            100,
+				HasGrid:         true,
+				PV:              300,
+				Bat:             100,
+				SelfConsumption: 500,
+				BatPercentage:   40,
+				HasBattery:      true,
+				Devices: []DeviceSummary{
+					{Address: "device2", Type: DeviceTypePV, Power: 300},
+					{Address: "device0", Type: DeviceTypeBattery, Power: 200, SoC: 50, Capacity: 10000},
+					{Address: "device1", Type: DeviceTypeBattery, Power: -100, SoC: 20, Capacity: 5000},
 				},
 			},
-			grid:     100,
-			exNewErr: true,
 		},
 	}
 
@@ -223,13 +544,17 @@ func TestNewPlant(t *testing.T) {
 				grid:  tt.grid,
 			}
 
-			var prs []PointReader
-			for _, v := range tt.devicesPoints {
+			var devices []Device
+			for i, v := range tt.devicesPoints {
 				dpr := &dummyPointReader{points: v}
-				prs = append(prs, dpr)
+				d := Device{Address: fmt.Sprintf("device%d", i), Reader: dpr}
+				if i < len(tt.capacities) {
+					d.Capacity = tt.capacities[i]
+				}
+				devices = append(devices, d)
 			}
 
-			plant, err := NewPlant(&em, prs...)
+			plant, err := NewPlant(&em, devices...)
 			if err != nil {
 				if tt.exNewErr {
 					return
@@ -237,7 +562,7 @@ func TestNewPlant(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			summary, err := plant.FetchSummary()
+			summary, err := plant.FetchSummary(context.Background())
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -254,5 +579,65 @@ func equalSummaryButTime(s1, s2 Summary) bool {
 	s1.TimestampEnd = time.Time{}
 	s2.TimestampStart = time.Time{}
 	s2.TimestampEnd = time.Time{}
-	return s1 == s2
+
+	withoutReadTime := func(devices []DeviceSummary) []DeviceSummary {
+		var res []DeviceSummary
+		for _, d := range devices {
+			d.LastRead = time.Time{}
+			res = append(res, d)
+		}
+		return res
+	}
+	s1.Devices = withoutReadTime(s1.Devices)
+	s2.Devices = withoutReadTime(s2.Devices)
+
+	return reflect.DeepEqual(s1, s2)
+}
+
+func TestErrorClass(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		err     error
+		exClass string
+	}{
+		{"NoData", &FetchError{Err: ErrNoData}, ErrorClassNoData},
+		{"Timeout", errors.Wrap(os.ErrDeadlineExceeded, "reading"), ErrorClassTimeout},
+		{"Connection", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, ErrorClassConnection},
+		{"Device", errors.Wrap(sunspec.ErrPointNotImplemented, "reading soc"), ErrorClassDevice},
+		{"Unknown", fmt.Errorf("dummy error"), ErrorClassUnknown},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if class := ErrorClass(tt.err); class != tt.exClass {
+				t.Fatalf("expected class %v, got %v", tt.exClass, class)
+			}
+		})
+	}
+}
+
+func Test_broadcaster(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var b broadcaster
+	c, unsubscribe := b.subscribe()
+
+	// the slow subscriber must only receive the latest summary
+	b.publish(Summary{PV: 100})
+	b.publish(Summary{PV: 200})
+
+	if s := <-c; s.PV != 200 {
+		t.Fatalf("expected latest summary, got %v", s)
+	}
+
+	unsubscribe()
+	b.publish(Summary{PV: 300})
+
+	if _, ok := <-c; ok {
+		t.Fatal("expected closed channel")
+	}
 }
@@ -0,0 +1,365 @@
+package plant
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Points of the SunSpec storage model, including the 2 registers of the model header.
+const (
+	storageModel            = 124
+	storagePointWChaMax     = 2
+	storagePointStorCtlMod  = 5
+	storagePointMinRsvPct   = 7
+	storagePointOutWRte     = 12
+	storagePointInWRte      = 13
+	storagePointRvrtTms     = 15
+	storagePointWChaMaxSF   = 18
+	storagePointMinRsvPctSF = 21
+	storagePointInOutWRteSF = 25
+)
+
+// Bits of StorCtl_Mod, enabling the charge and discharge limits.
+const (
+	storCtlCharge    = 1 << 0
+	storCtlDischarge = 1 << 1
+)
+
+var (
+	// ErrInvalidSetpoint is returned for setpoints outside the limits of a battery.
+	ErrInvalidSetpoint = errors.New("invalid setpoint")
+	// ErrNotControllable is returned for batteries without limits, which must not be controlled.
+	ErrNotControllable = errors.New("battery is not controllable")
+	// ErrNotWritable is returned if the connection to a device doesn't support writes.
+	ErrNotWritable = errors.New("device is not writable")
+	// ErrDeviceNotFound is returned if a plant has no device with the address.
+	ErrDeviceNotFound = errors.New("device not found")
+)
+
+func storagePoint(point uint16, t interface{}) sunspec.Point {
+	return sunspec.Point{Model: storageModel, Point: point, T: t}
+}
+
+// pointWriter is implemented by readers which can write registers of SunSpec models.
+type pointWriter interface {
+	WritePoint(model, point uint16, values ...uint16) error
+}
+
+// BatteryLimits are the safety bounds of the setpoints of a battery.
+type BatteryLimits struct {
+	// MaxChargePower and MaxDischargePower bound the charge and discharge limits in W, 0 for the rated power of the
+	// battery.
+	MaxChargePower, MaxDischargePower float64
+	// MinReserve and MaxReserve bound the minimum reserve SoC in percent.
+	MinReserve, MaxReserve float64
+	// MaxTimeout is the maximum time until a setpoint is reverted, used if a setpoint has no timeout.
+	MaxTimeout time.Duration
+}
+
+// BatterySetpoint limits the power of a battery until it is reverted.
+type BatterySetpoint struct {
+	// ChargeLimit and DischargeLimit limit the power in W, nil for no limit.
+	ChargeLimit, DischargeLimit *float64
+	// MinReserve is the SoC in percent the battery isn't discharged below, nil to keep the current reserve.
+	MinReserve *float64
+	// Timeout is the time until the setpoint is reverted, 0 for the maximum timeout of the battery.
+	Timeout time.Duration
+}
+
+// batteryController writes setpoints to a battery using the storage model and reverts them after their timeout.
+//
+// The revert timeout of the charge and discharge rates is also written to the battery, so the rates are reverted
+// even if the server stops.
+type batteryController struct {
+	addr   string
+	mr     PointReader
+	limits BatteryLimits
+
+	m     sync.Mutex
+	timer *time.Timer
+	// gen is incremented by each setpoint, so the timer of a replaced setpoint doesn't revert the new one.
+	gen uint64
+	// active is true while a setpoint wasn't reverted.
+	active bool
+	// reserve is the raw reserve before the first active setpoint, restored on revert. nil if the reserve wasn't
+	// changed.
+	reserve *uint16
+}
+
+// set writes the setpoint and returns the time it is reverted at.
+func (c *batteryController) set(ctx context.Context, sp BatterySetpoint) (time.Time, error) {
+	timeout := sp.Timeout
+	if timeout == 0 {
+		timeout = c.limits.MaxTimeout
+	}
+	if timeout < time.Second || timeout > c.limits.MaxTimeout {
+		return time.Time{}, errors.Wrap(ErrInvalidSetpoint, fmt.Sprintf("timeout must be between 1s and %v",
+			c.limits.MaxTimeout))
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	rated, err := readScaled(ctx, c.mr, storageModel, storagePointWChaMax, storagePointWChaMaxSF, uint16(0))
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "reading rated power")
+	}
+	if rated <= 0 {
+		return time.Time{}, fmt.Errorf("battery %v has no rated power", c.addr)
+	}
+
+	mode := uint16(0)
+	inRate, outRate := 100.0, 100.0
+
+	if sp.ChargeLimit != nil {
+		err := checkBounds("charge limit", *sp.ChargeLimit, 0, orDefault(c.limits.MaxChargePower, rated))
+		if err != nil {
+			return time.Time{}, err
+		}
+		mode |= storCtlCharge
+		inRate = *sp.ChargeLimit / rated * 100
+	}
+	if sp.DischargeLimit != nil {
+		err := checkBounds("discharge limit", *sp.DischargeLimit, 0, orDefault(c.limits.MaxDischargePower, rated))
+		if err != nil {
+			return time.Time{}, err
+		}
+		mode |= storCtlDischarge
+		outRate = *sp.DischargeLimit / rated * 100
+	}
+	if sp.MinReserve != nil {
+		err := checkBounds("minimum reserve", *sp.MinReserve, c.limits.MinReserve, c.limits.MaxReserve)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	rateSF, err := getAnyPoint(ctx, c.mr, storagePoint(storagePointInOutWRteSF, int16(0)))
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "reading rate scale factor")
+	}
+
+	// the battery reverts the rates on its own, the server might not be running anymore after the timeout
+	revertSeconds := math.Min(timeout.Seconds(), math.MaxUint16)
+	writes := []struct {
+		point  uint16
+		values []uint16
+	}{
+		// InWRte follows OutWRte
+		{storagePointOutWRte, []uint16{toRaw(outRate, rateSF), toRaw(inRate, rateSF)}},
+		{storagePointRvrtTms, []uint16{uint16(revertSeconds)}},
+		{storagePointStorCtlMod, []uint16{mode}},
+	}
+
+	// the writes aren't abandoned if ctx is done, e.g. when the client disconnects, as they may reach the battery anyway
+	wctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	// the limits must be reverted even if only some of the writes succeed
+	c.active = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.gen++
+	gen := c.gen
+	revertAt := time.Now().Add(timeout)
+	c.timer = time.AfterFunc(timeout, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		defer cancel()
+
+		c.m.Lock()
+		defer c.m.Unlock()
+
+		// the timer may have fired while the setpoint was replaced
+		if c.gen != gen {
+			return
+		}
+		err := c.revertLocked(ctx)
+		if err != nil {
+			log.Println(errors.Wrap(err, fmt.Sprintf("error reverting setpoint of battery %v", c.addr)))
+		}
+	})
+
+	for _, w := range writes {
+		err := writePoint(wctx, c.mr, storageModel, w.point, w.values...)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, fmt.Sprintf("writing setpoint of battery %v", c.addr))
+		}
+	}
+
+	if sp.MinReserve != nil {
+		err := c.writeReserve(wctx, *sp.MinReserve)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, fmt.Sprintf("writing reserve of battery %v", c.addr))
+		}
+	}
+
+	return revertAt, nil
+}
+
+// writeReserve writes the minimum reserve in percent, the previous reserve is kept to be restored on revert.
+func (c *batteryController) writeReserve(ctx context.Context, reserve float64) error {
+	sf, err := getAnyPoint(ctx, c.mr, storagePoint(storagePointMinRsvPctSF, int16(0)))
+	if err != nil {
+		return err
+	}
+
+	if c.reserve == nil {
+		prev, err := getAnyPoint(ctx, c.mr, storagePoint(storagePointMinRsvPct, uint16(0)))
+		if err != nil {
+			return err
+		}
+		raw := uint16(prev)
+		c.reserve = &raw
+	}
+
+	return writePoint(ctx, c.mr, storageModel, storagePointMinRsvPct, toRaw(reserve, sf))
+}
+
+// revert disables the charge and discharge limits and restores the reserve. It does nothing if no setpoint is active.
+func (c *batteryController) revert(ctx context.Context) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.revertLocked(ctx)
+}
+
+// revertLocked is revert with the lock held.
+func (c *batteryController) revertLocked(ctx context.Context) error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if !c.active {
+		return nil
+	}
+
+	err := writePoint(ctx, c.mr, storageModel, storagePointStorCtlMod, 0)
+	if err != nil {
+		return err
+	}
+
+	if c.reserve != nil {
+		err := writePoint(ctx, c.mr, storageModel, storagePointMinRsvPct, *c.reserve)
+		if err != nil {
+			return err
+		}
+		c.reserve = nil
+	}
+
+	c.active = false
+	return nil
+}
+
+// SetBattery writes the setpoint to the battery at the address, or to the only controllable battery of the plant if
+// the address is empty. It returns the time the setpoint is reverted at.
+func (p *Plant) SetBattery(ctx context.Context, addr string, sp BatterySetpoint) (time.Time, error) {
+	c, err := p.batteryController(addr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return c.set(ctx, sp)
+}
+
+// RevertBattery reverts the setpoint of the battery before its timeout, see SetBattery for the address.
+func (p *Plant) RevertBattery(ctx context.Context, addr string) error {
+	c, err := p.batteryController(addr)
+	if err != nil {
+		return err
+	}
+	return c.revert(ctx)
+}
+
+func (p *Plant) batteryController(addr string) (*batteryController, error) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	var controllers []*batteryController
+	for _, v := range p.Bats {
+		b, ok := v.(*batteryInverter)
+		if !ok {
+			continue
+		}
+
+		if addr != "" && b.addr == addr {
+			if b.control == nil {
+				return nil, errors.Wrap(ErrNotControllable, fmt.Sprintf("battery %v has no limits", addr))
+			}
+			return b.control, nil
+		}
+		if b.control != nil {
+			controllers = append(controllers, b.control)
+		}
+	}
+
+	switch {
+	case addr != "":
+		return nil, errors.Wrap(ErrDeviceNotFound, fmt.Sprintf("no battery %v", addr))
+	case len(controllers) == 0:
+		return nil, errors.Wrap(ErrNotControllable, "plant has no controllable battery")
+	case len(controllers) > 1:
+		return nil, errors.Wrap(ErrInvalidSetpoint, "plant has multiple controllable batteries, address required")
+	default:
+		return controllers[0], nil
+	}
+}
+
+func checkBounds(name string, v, min, max float64) error {
+	if v < min || v > max {
+		return errors.Wrap(ErrInvalidSetpoint, fmt.Sprintf("%v must be between %v and %v", name, min, max))
+	}
+	return nil
+}
+
+func orDefault(v, def float64) float64 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// toRaw converts the value to the register value of a signed point with the scale factor.
+func toRaw(v, sf float64) uint16 {
+	return uint16(int16(math.Round(v / math.Pow10(int(sf)))))
+}
+
+// readScaled reads the point of type t of the model and applies the scale factor read from point sf.
+func readScaled(ctx context.Context, r PointReader, model, point, sf uint16, t interface{}) (float64, error) {
+	v, err := getAnyPoint(ctx, r, sunspec.Point{Model: model, Point: point, T: t})
+	if err != nil {
+		return 0, err
+	}
+
+	factor, err := getAnyPoint(ctx, r, sunspec.Point{Model: model, Point: sf, T: int16(0)})
+	if err != nil {
+		return 0, err
+	}
+
+	return v * math.Pow10(int(factor)), nil
+}
+
+// writePoint writes the values starting at the point of the model, or returns the error of the context if it is done
+// first.
+func writePoint(ctx context.Context, r PointReader, model, point uint16, values ...uint16) error {
+	w, ok := r.(pointWriter)
+	if !ok {
+		return ErrNotWritable
+	}
+
+	c := make(chan error, 1)
+	go func() {
+		c <- w.WritePoint(model, point, values...)
+	}()
+
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,284 @@
+package plant
+
+import (
+	"context"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storagePointReader is a battery inverter with writable registers of the storage model.
+type storagePointReader struct {
+	dummyPointReader
+
+	m         sync.Mutex
+	registers map[uint16]uint16
+	// writeDelay delays each write, e.g. to let a timer fire while a setpoint is written.
+	writeDelay time.Duration
+}
+
+func newStoragePointReader() *storagePointReader {
+	return &storagePointReader{
+		dummyPointReader: dummyPointReader{points: map[sunspec.Point]float64{
+			sunspec.PointPower1Phase: 100,
+			sunspec.PointSoc:         50,
+		}},
+		registers: map[uint16]uint16{
+			storagePointWChaMax:     5000,
+			storagePointWChaMaxSF:   0,
+			storagePointMinRsvPct:   10,
+			storagePointMinRsvPctSF: 0,
+			// percent with 2 decimals
+			storagePointInOutWRteSF: uint16(0xFFFE),
+		},
+	}
+}
+
+func (s *storagePointReader) GetAnyPoint(ps ...sunspec.Point) (float64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, p := range ps {
+		v, ok := s.registers[p.Point]
+		if p.Model != storageModel || !ok {
+			continue
+		}
+		if _, signed := p.T.(int16); signed {
+			return float64(int16(v)), nil
+		}
+		return float64(v), nil
+	}
+
+	return s.dummyPointReader.GetAnyPoint(ps...)
+}
+
+func (s *storagePointReader) WritePoint(model, point uint16, values ...uint16) error {
+	s.m.Lock()
+	delay := s.writeDelay
+	s.m.Unlock()
+	time.Sleep(delay)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if model != storageModel {
+		return sunspec.ErrPointNotImplemented
+	}
+	for i, v := range values {
+		s.registers[point+uint16(i)] = v
+	}
+	return nil
+}
+
+func (s *storagePointReader) register(point uint16) uint16 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.registers[point]
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+var testBatteryLimits = BatteryLimits{MinReserve: 10, MaxReserve: 80, MaxTimeout: time.Hour}
+
+func TestPlant_SetBattery(t *testing.T) {
+	t.Parallel()
+
+	battery := newStoragePointReader()
+	p, err := NewPlant(nil, Device{Address: "battery", Reader: battery, Limits: &testBatteryLimits})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revertAt, err := p.SetBattery(context.Background(), "", BatterySetpoint{
+		ChargeLimit: float(1000),
+		MinReserve:  float(20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(revertAt); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("expected revert after the maximum timeout, got %v", revertAt)
+	}
+
+	expected := map[uint16]uint16{
+		storagePointStorCtlMod: storCtlCharge,
+		storagePointInWRte:     2000,
+		storagePointOutWRte:    10000,
+		storagePointRvrtTms:    3600,
+		storagePointMinRsvPct:  20,
+	}
+	for point, v := range expected {
+		if r := battery.register(point); r != v {
+			t.Fatalf("expected %v at point %v, got %v", v, point, r)
+		}
+	}
+
+	err = p.RevertBattery(context.Background(), "battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := battery.register(storagePointStorCtlMod); r != 0 {
+		t.Fatalf("expected limits to be disabled, got mode %v", r)
+	}
+	if r := battery.register(storagePointMinRsvPct); r != 10 {
+		t.Fatalf("expected previous reserve to be restored, got %v", r)
+	}
+}
+
+func TestPlant_SetBattery_invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		addr  string
+		sp    BatterySetpoint
+		exErr error
+	}{
+		{name: "ChargeAboveRated", sp: BatterySetpoint{ChargeLimit: float(6000)}, exErr: ErrInvalidSetpoint},
+		{name: "NegativeDischarge", sp: BatterySetpoint{DischargeLimit: float(-1)}, exErr: ErrInvalidSetpoint},
+		{name: "ReserveBelowBounds", sp: BatterySetpoint{MinReserve: float(5)}, exErr: ErrInvalidSetpoint},
+		{name: "ReserveAboveBounds", sp: BatterySetpoint{MinReserve: float(90)}, exErr: ErrInvalidSetpoint},
+		{name: "TimeoutAboveBounds", sp: BatterySetpoint{Timeout: 2 * time.Hour}, exErr: ErrInvalidSetpoint},
+		{name: "NotControllable", addr: "uncontrolled", exErr: ErrNotControllable},
+		{name: "UnknownBattery", addr: "unknown", exErr: ErrDeviceNotFound},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			battery := newStoragePointReader()
+			p, err := NewPlant(nil,
+				Device{Address: "battery", Reader: battery, Limits: &testBatteryLimits},
+				Device{Address: "uncontrolled", Reader: newStoragePointReader()},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = p.SetBattery(context.Background(), tt.addr, tt.sp)
+			if !errors.Is(err, tt.exErr) {
+				t.Fatalf("expected %v, got %v", tt.exErr, err)
+			}
+
+			// nothing is written
+			if r := battery.register(storagePointStorCtlMod); r != 0 {
+				t.Fatalf("expected no limits, got mode %v", r)
+			}
+		})
+	}
+}
+
+func TestPlant_SetBattery_timeout(t *testing.T) {
+	t.Parallel()
+
+	battery := newStoragePointReader()
+	p, err := NewPlant(nil, Device{Address: "battery", Reader: battery, Limits: &testBatteryLimits})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.SetBattery(context.Background(), "battery", BatterySetpoint{
+		DischargeLimit: float(0),
+		MinReserve:     float(50),
+		Timeout:        time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for battery.register(storagePointStorCtlMod) != 0 || battery.register(storagePointMinRsvPct) != 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("setpoint wasn't reverted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if r := battery.register(storagePointRvrtTms); r != 1 {
+		t.Fatalf("expected revert timeout of the battery, got %v", r)
+	}
+
+	// reverting again does nothing
+	_ = battery.WritePoint(storageModel, storagePointMinRsvPct, 30)
+	err = p.RevertBattery(context.Background(), "battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := battery.register(storagePointMinRsvPct); r != 30 {
+		t.Fatal("expected reserve not to be changed without active setpoint")
+	}
+}
+
+func TestPlant_SetBattery_refresh(t *testing.T) {
+	t.Parallel()
+
+	battery := newStoragePointReader()
+	p, err := NewPlant(nil, Device{Address: "battery", Reader: battery, Limits: &testBatteryLimits})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp := BatterySetpoint{DischargeLimit: float(0), Timeout: time.Second}
+	_, err = p.SetBattery(context.Background(), "battery", sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the setpoint is refreshed right at its timeout, so the timer fires while the new setpoint is written
+	battery.m.Lock()
+	battery.writeDelay = 400 * time.Millisecond
+	battery.m.Unlock()
+	time.Sleep(800 * time.Millisecond)
+	sp.Timeout = 5 * time.Second
+	_, err = p.SetBattery(context.Background(), "battery", sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	battery.m.Lock()
+	battery.writeDelay = 0
+	battery.m.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if r := battery.register(storagePointStorCtlMod); r != storCtlDischarge {
+		t.Fatalf("expected refreshed setpoint to stay active, got StorCtl_Mod %v", r)
+	}
+}
+
+func TestPlant_SetBattery_cancel(t *testing.T) {
+	t.Parallel()
+
+	battery := newStoragePointReader()
+	p, err := NewPlant(nil, Device{Address: "battery", Reader: battery, Limits: &testBatteryLimits})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client disconnects while the setpoint is written
+	battery.m.Lock()
+	battery.writeDelay = 20 * time.Millisecond
+	battery.m.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(30*time.Millisecond, cancel)
+
+	_, err = p.SetBattery(ctx, "battery", BatterySetpoint{DischargeLimit: float(0), Timeout: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := battery.register(storagePointStorCtlMod); r != storCtlDischarge {
+		t.Fatalf("expected setpoint to be written completely, got StorCtl_Mod %v", r)
+	}
+
+	err = p.RevertBattery(context.Background(), "battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := battery.register(storagePointStorCtlMod); r != 0 {
+		t.Fatalf("expected setpoint to be reverted, got StorCtl_Mod %v", r)
+	}
+}
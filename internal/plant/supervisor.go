@@ -0,0 +1,263 @@
+package plant
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Connection states of a ConnState.
+const (
+	// ConnStatePending is the state of a device which wasn't connected yet.
+	ConnStatePending      = "pending"
+	ConnStateConnected    = "connected"
+	ConnStateReconnecting = "reconnecting"
+)
+
+const (
+	// reconnectBackoffStart is the delay before the first reconnect attempt, doubled after each failed attempt.
+	reconnectBackoffStart = time.Second
+	// reconnectBackoffMax is the maximum delay between two reconnect attempts.
+	reconnectBackoffMax = 5 * time.Minute
+)
+
+// ErrDisconnected is returned by a SupervisedReader while it is reconnecting.
+var ErrDisconnected = errors.New("device disconnected")
+
+// Dialer connects to the SunSpec device at the address. If the returned reader implements io.Closer, it is closed
+// after its connection broke.
+type Dialer func(addr string) (PointReader, error)
+
+// ConnState is the connection state of a supervised device.
+type ConnState struct {
+	// State is one of the ConnState* constants, empty if the device isn't supervised.
+	State string
+	// Since is the time of the last change of the state.
+	Since time.Time
+	// Err is the error which broke the connection, or the error of the last connect attempt.
+	Err error
+	// Attempts is the number of failed connect attempts.
+	Attempts int
+}
+
+// connStater is implemented by readers reporting their connection state.
+type connStater interface {
+	connState() ConnState
+}
+
+// connStateOf returns the connection state of the reader, the zero value if it isn't supervised.
+func connStateOf(r PointReader) ConnState {
+	if s, ok := r.(connStater); ok {
+		return s.connState()
+	}
+	return ConnState{}
+}
+
+// disconnected returns true if the device is supervised and not connected, e.g. an inverter sleeping at night.
+func disconnected(d interface{}) bool {
+	s, ok := d.(connStater)
+	if !ok {
+		return false
+	}
+	state := s.connState().State
+	return state == ConnStatePending || state == ConnStateReconnecting
+}
+
+// SupervisedReader is a PointReader which reconnects to its device after the connection broke.
+//
+// Reconnect attempts use exponential backoff with jitter. While not connected, reads return ErrDisconnected.
+type SupervisedReader struct {
+	ctx  context.Context
+	addr string
+	dial Dialer
+
+	m sync.Mutex
+	r PointReader
+	// verify checks each new connection, e.g. whether the device type didn't change.
+	verify func(PointReader) error
+	state  ConnState
+}
+
+// Supervise creates a reader of the device at the address. The device is pending until NewPlant connects to it.
+// Connect attempts stop when the context is done.
+func Supervise(ctx context.Context, addr string, dial Dialer) *SupervisedReader {
+	return &SupervisedReader{
+		ctx:   ctx,
+		addr:  addr,
+		dial:  dial,
+		state: ConnState{State: ConnStatePending, Since: time.Now()},
+	}
+}
+
+// start connects to the device in the background, verifying each new connection. The device is pending until the
+// first connection succeeded, so an unreachable device doesn't delay the start of its plant.
+func (s *SupervisedReader) start(verify func(PointReader) error) {
+	s.m.Lock()
+	s.verify = verify
+	s.m.Unlock()
+
+	go func() {
+		if !s.attempt(0) {
+			s.reconnect(1)
+		}
+	}()
+}
+
+func (s *SupervisedReader) GetAnyPoint(ps ...sunspec.Point) (float64, error) {
+	r, err := s.reader()
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := r.GetAnyPoint(ps...)
+	s.check(r, err)
+	return v, err
+}
+
+func (s *SupervisedReader) HasAnyPoint(ps ...sunspec.Point) (bool, sunspec.Point, error) {
+	r, err := s.reader()
+	if err != nil {
+		return false, sunspec.Point{}, err
+	}
+
+	ok, p, err := r.HasAnyPoint(ps...)
+	s.check(r, err)
+	return ok, p, err
+}
+
+// WritePoint writes the values starting at the point of the model, if the connection supports writes.
+func (s *SupervisedReader) WritePoint(model, point uint16, values ...uint16) error {
+	r, err := s.reader()
+	if err != nil {
+		return err
+	}
+
+	w, ok := r.(pointWriter)
+	if !ok {
+		return ErrNotWritable
+	}
+
+	err = w.WritePoint(model, point, values...)
+	s.check(r, err)
+	return err
+}
+
+func (s *SupervisedReader) reader() (PointReader, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.r == nil {
+		return nil, errors.Wrap(ErrDisconnected, fmt.Sprintf("%v %v since %v", s.addr, s.state.State,
+			s.state.Since.Format(time.RFC3339)))
+	}
+	return s.r, nil
+}
+
+func (s *SupervisedReader) connState() ConnState {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.state
+}
+
+// check starts reconnecting if the error of a read from r means that the connection broke.
+func (s *SupervisedReader) check(r PointReader, err error) {
+	if err == nil {
+		return
+	}
+	if class := ErrorClass(err); class != ErrorClassConnection && class != ErrorClassTimeout {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// another read already noticed the broken connection
+	if s.r != r {
+		return
+	}
+
+	if c, ok := r.(io.Closer); ok {
+		_ = c.Close()
+	}
+	s.r = nil
+	s.state = ConnState{State: ConnStateReconnecting, Since: time.Now(), Err: err}
+
+	go s.reconnect(0)
+}
+
+// reconnect connects to the device, starting with the given attempt.
+func (s *SupervisedReader) reconnect(attempt int) {
+	for ; ; attempt++ {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(backoff(attempt)):
+		}
+
+		if s.attempt(attempt) {
+			return
+		}
+	}
+}
+
+// attempt connects to the device and updates the state, returning whether the attempt succeeded.
+func (s *SupervisedReader) attempt(attempt int) bool {
+	r, err := s.connect()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if err != nil {
+		s.state.Err = err
+		s.state.Attempts = attempt + 1
+		return false
+	}
+
+	s.r = r
+	s.state = ConnState{State: ConnStateConnected, Since: time.Now()}
+	return true
+}
+
+// connect dials the device and verifies the new connection.
+func (s *SupervisedReader) connect() (PointReader, error) {
+	r, err := s.dial(s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	verify := s.verify
+	s.m.Unlock()
+
+	if verify == nil {
+		return r, nil
+	}
+
+	err = verify(r)
+	if err != nil {
+		if c, ok := r.(io.Closer); ok {
+			_ = c.Close()
+		}
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// backoff returns the delay before the reconnect attempt. The delay is randomized within its upper half, so devices
+// which failed at the same time don't reconnect at the same time.
+func backoff(attempt int) time.Duration {
+	d := reconnectBackoffMax
+	if attempt < 16 {
+		if b := reconnectBackoffStart << uint(attempt); b < d {
+			d = b
+		}
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,281 @@
+package plant
+
+import (
+	"context"
+	"github.com/orlopau/go-energy/pkg/sunspec"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForState fails the test if the connection state of the reader doesn't satisfy f within the timeout.
+func waitForState(t *testing.T, s *SupervisedReader, timeout time.Duration, f func(ConnState) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !f(s.connState()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected connection state %+v", s.connState())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func connected(state ConnState) bool {
+	return state.State == ConnStateConnected
+}
+
+// closingPointReader records whether it was closed.
+type closingPointReader struct {
+	dummyPointReader
+	m      sync.Mutex
+	closed bool
+}
+
+func (c *closingPointReader) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *closingPointReader) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.closed
+}
+
+func TestSupervisedReader_reconnect(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broken := &closingPointReader{dummyPointReader: dummyPointReader{err: io.EOF}}
+	healthy := &closingPointReader{dummyPointReader: dummyPointReader{
+		points: map[sunspec.Point]float64{sunspec.PointPower1Phase: 100},
+	}}
+
+	var m sync.Mutex
+	readers := []PointReader{broken, healthy}
+	dial := func(addr string) (PointReader, error) {
+		m.Lock()
+		defer m.Unlock()
+		r := readers[0]
+		readers = readers[1:]
+		return r, nil
+	}
+
+	s := Supervise(ctx, "device0", dial)
+	s.start(nil)
+	waitForState(t, s, time.Second, connected)
+
+	// the broken connection is closed and replaced
+	_, err := s.GetAnyPoint(sunspec.PointPower1Phase)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if state := s.connState(); state.State != ConnStateReconnecting || !errors.Is(state.Err, io.EOF) {
+		t.Fatalf("expected reconnecting device, got %+v", state)
+	}
+	if !broken.isClosed() {
+		t.Fatal("expected broken connection to be closed")
+	}
+
+	_, err = s.GetAnyPoint(sunspec.PointPower1Phase)
+	if !errors.Is(err, ErrDisconnected) || ErrorClass(err) != ErrorClassConnection {
+		t.Fatalf("expected disconnected error, got %v", err)
+	}
+
+	waitForState(t, s, 2*reconnectBackoffStart, connected)
+
+	v, err := s.GetAnyPoint(sunspec.PointPower1Phase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 100 {
+		t.Fatalf("expected 100, got %v", v)
+	}
+}
+
+func TestSupervisedReader_connect_verify(t *testing.T) {
+	t.Parallel()
+
+	battery := &closingPointReader{dummyPointReader: dummyPointReader{points: map[sunspec.Point]float64{
+		sunspec.PointPower1Phase: 100,
+		sunspec.PointSoc:         50,
+	}}}
+	dial := func(addr string) (PointReader, error) {
+		return battery, nil
+	}
+
+	s := Supervise(context.Background(), "device0", func(addr string) (PointReader, error) {
+		return &dummyPointReader{points: map[sunspec.Point]float64{sunspec.PointPower1Phase: 100}}, nil
+	})
+
+	_, err := NewPlant(nil, Device{Address: "device0", Reader: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, s, time.Second, connected)
+
+	// the PV inverter must not turn into a battery inverter
+	s.dial = dial
+	_, err = s.connect()
+	if err == nil {
+		t.Fatal("expected error after device type changed")
+	}
+	if !battery.isClosed() {
+		t.Fatal("expected rejected connection to be closed")
+	}
+}
+
+func TestNewPlant_pending(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	offline := errors.New("connection refused")
+	var m sync.Mutex
+	online := false
+	dial := func(addr string) (PointReader, error) {
+		m.Lock()
+		defer m.Unlock()
+		if !online {
+			return nil, offline
+		}
+		return &dummyPointReader{points: map[sunspec.Point]float64{sunspec.PointPower1Phase: 100}}, nil
+	}
+
+	s := Supervise(ctx, "device0", dial)
+	plant, err := NewPlant(&dummyEnergyMeter{grid: 50}, Device{Address: "device0", Reader: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, s, time.Second, func(state ConnState) bool {
+		return state.Attempts == 1
+	})
+
+	summary, err := plant.FetchSummary(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.PV != 0 || len(summary.Devices) != 1 {
+		t.Fatalf("expected only a pending device, got %+v", summary)
+	}
+	d := summary.Devices[0]
+	if d.Type != DeviceTypeUnknown || d.Connection.State != ConnStatePending || !errors.Is(d.Err, offline) {
+		t.Fatalf("expected pending device, got %+v", d)
+	}
+
+	m.Lock()
+	online = true
+	m.Unlock()
+
+	deadline := time.Now().Add(2 * reconnectBackoffStart)
+	for {
+		summary, err = plant.FetchSummary(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.PV == 100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("device wasn't added, got %+v", summary)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if d := summary.Devices[0]; len(summary.Devices) != 1 || d.Type != DeviceTypePV ||
+		d.Connection.State != ConnStateConnected {
+		t.Fatalf("expected connected PV inverter, got %+v", summary.Devices)
+	}
+}
+
+func TestPlant_FetchSummary_disconnected(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the inverter goes to sleep after it was detected and can't be reconnected
+	var m sync.Mutex
+	sleeping := &dummyPointReader{points: map[sunspec.Point]float64{sunspec.PointPower1Phase: 300}, err: io.EOF}
+	readers := []PointReader{sleeping}
+	dial := func(addr string) (PointReader, error) {
+		m.Lock()
+		defer m.Unlock()
+		if len(readers) == 0 {
+			return nil, errors.New("connection refused")
+		}
+		r := readers[0]
+		readers = readers[1:]
+		return r, nil
+	}
+
+	s0 := Supervise(ctx, "device0", dial)
+	s1 := Supervise(ctx, "device1", func(addr string) (PointReader, error) {
+		return &dummyPointReader{points: map[sunspec.Point]float64{sunspec.PointPower1Phase: 100}}, nil
+	})
+	plant, err := NewPlant(&dummyEnergyMeter{grid: 50}, Device{Address: "device0", Reader: s0},
+		Device{Address: "device1", Reader: s1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, s0, time.Second, connected)
+	waitForState(t, s1, time.Second, connected)
+	waitForInverters := func() {
+		deadline := time.Now().Add(time.Second)
+		for {
+			plant.m.RLock()
+			n := len(plant.Inverters)
+			plant.m.RUnlock()
+			if n == 2 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("inverters weren't added")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForInverters()
+
+	// the plant keeps reporting the other inverter, before and after the broken connection was noticed
+	for i := 0; i < 2; i++ {
+		summary, err := plant.FetchSummary(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.PV != 100 {
+			t.Fatalf("expected PV of the connected inverter, got %v", summary.PV)
+		}
+
+		for _, d := range summary.Devices {
+			if d.Address != "device0" {
+				continue
+			}
+			if d.Connection.State != ConnStateReconnecting || d.Err == nil || d.Power != 0 {
+				t.Fatalf("expected disconnected device with error, got %+v", d)
+			}
+		}
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	t.Parallel()
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if d := backoff(attempt); d < max/2 || d > max {
+			t.Fatalf("expected backoff of attempt %v between %v and %v, got %v", attempt, max/2, max, d)
+		}
+	}
+
+	if d := backoff(100); d < reconnectBackoffMax/2 || d > reconnectBackoffMax {
+		t.Fatalf("expected backoff to be capped at %v, got %v", reconnectBackoffMax, d)
+	}
+}
@@ -0,0 +1,130 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/modbus"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Actuator switches a load on or off.
+type Actuator interface {
+	Switch(ctx context.Context, on bool) error
+}
+
+// Webhook sends an HTTP request on each switch.
+//
+// The placeholder {state} in the URL is replaced by on or off. Requests other than GET have a JSON body
+// {"on": true|false}.
+type Webhook struct {
+	URL string
+	// Method defaults to POST.
+	Method string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (w *Webhook) Switch(ctx context.Context, on bool) error {
+	method := w.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var body bytes.Buffer
+	if method != http.MethodGet {
+		err := json.NewEncoder(&body).Encode(struct {
+			On bool `json:"on"`
+		}{on})
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, strings.ReplaceAll(w.URL, "{state}", state(on)), &body)
+	if err != nil {
+		return errors.Wrap(err, "creating webhook request")
+	}
+	if body.Len() > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "calling webhook")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %v", res.Status)
+	}
+	return nil
+}
+
+// Publisher publishes MQTT messages.
+type Publisher interface {
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+}
+
+// MQTT publishes a payload to a topic on each switch.
+type MQTT struct {
+	Publisher Publisher
+	Topic     string
+	// On and Off are the payloads, defaulting to ON and OFF.
+	On, Off  string
+	QoS      byte
+	Retained bool
+}
+
+func (m *MQTT) Switch(ctx context.Context, on bool) error {
+	payload := orDefault(m.Off, "OFF")
+	if on {
+		payload = orDefault(m.On, "ON")
+	}
+
+	err := m.Publisher.Publish(m.Topic, m.QoS, m.Retained, []byte(payload))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("publishing to %v", m.Topic))
+	}
+	return nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// ModbusCoil switches a coil of a modbus TCP device, e.g. a relay.
+//
+// A new connection is used for each switch, as switches are rare.
+type ModbusCoil struct {
+	Address string
+	SlaveID byte
+	Coil    uint16
+	// Timeout is the timeout of connecting and of the request.
+	Timeout time.Duration
+}
+
+func (m *ModbusCoil) Switch(ctx context.Context, on bool) error {
+	c, err := modbus.Dial(m.Address, m.SlaveID, m.Timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = c.WriteCoil(m.Coil, on)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("writing coil %v of %v", m.Coil, m.Address))
+	}
+	return nil
+}
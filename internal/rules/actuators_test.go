@@ -0,0 +1,103 @@
+package rules
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhook_Switch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		on       bool
+		exMethod string
+		exPath   string
+		exBody   string
+		exErr    bool
+	}{
+		{name: "Post", on: true, status: http.StatusOK, exMethod: http.MethodPost, exPath: "/on",
+			exBody: "{\"on\":true}\n"},
+		{name: "Get", method: http.MethodGet, status: http.StatusNoContent, exMethod: http.MethodGet, exPath: "/off"},
+		{name: "ErrorStatus", status: http.StatusInternalServerError, exErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var method, path, body string
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				method, path, body = r.Method, r.URL.Path, string(b)
+				w.WriteHeader(tt.status)
+			}))
+			defer s.Close()
+
+			w := &Webhook{URL: s.URL + "/{state}", Method: tt.method}
+			err := w.Switch(context.Background(), tt.on)
+			if tt.exErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if method != tt.exMethod || path != tt.exPath || body != tt.exBody {
+				t.Fatalf("expected %v %v %q, got %v %v %q", tt.exMethod, tt.exPath, tt.exBody, method, path, body)
+			}
+		})
+	}
+}
+
+type dummyPublisher struct {
+	err      error
+	topic    string
+	qos      byte
+	retained bool
+	payload  string
+}
+
+func (d *dummyPublisher) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	d.topic, d.qos, d.retained, d.payload = topic, qos, retained, string(payload)
+	return d.err
+}
+
+func TestMQTT_Switch(t *testing.T) {
+	t.Parallel()
+
+	p := &dummyPublisher{}
+	m := &MQTT{Publisher: p, Topic: "heater/set", QoS: 1, Retained: true}
+
+	err := m.Switch(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.topic != "heater/set" || p.qos != 1 || !p.retained || p.payload != "ON" {
+		t.Fatalf("unexpected message %+v", p)
+	}
+
+	m.Off = "0"
+	err = m.Switch(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.payload != "0" {
+		t.Fatalf("expected configured payload, got %q", p.payload)
+	}
+
+	p.err = errors.New("not connected")
+	if err := m.Switch(context.Background(), true); !errors.Is(err, p.err) {
+		t.Fatalf("expected publish error, got %v", err)
+	}
+}
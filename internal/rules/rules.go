@@ -0,0 +1,293 @@
+// Package rules switches loads depending on the summaries of a plant, e.g. to use surplus PV power.
+package rules
+
+import (
+	"context"
+	"fmt"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+const (
+	// retryDelayStart is the delay before a failed switch is retried, doubled after each failed attempt.
+	retryDelayStart = 5 * time.Second
+	// retryDelayMax is the maximum delay before a failed switch is retried.
+	retryDelayMax = 5 * time.Minute
+)
+
+// Values of a summary conditions may refer to, named like in the summaries of the API.
+const (
+	ValueGrid            = "grid"
+	ValuePV              = "pv"
+	ValueBattery         = "battery"
+	ValueBatterySoC      = "batterySoC"
+	ValueSelfConsumption = "selfConsumption"
+)
+
+// Condition compares a value of the summaries to a threshold.
+type Condition struct {
+	Value string
+	// Below and Above are the thresholds, exactly one of them must be set.
+	Below, Above *float64
+	// Hysteresis moves the threshold once the condition is met, so it stays met until the value crosses the threshold
+	// by the hysteresis.
+	Hysteresis float64
+	// For is the time the condition must be met before it holds.
+	For time.Duration
+
+	met   bool
+	since time.Time
+}
+
+// Validate returns an error if the condition is incomplete.
+func (c *Condition) Validate() error {
+	if _, ok := value(plant.Summary{HasGrid: true, HasBattery: true}, c.Value); !ok {
+		return fmt.Errorf("unknown value %q", c.Value)
+	}
+	if (c.Below == nil) == (c.Above == nil) {
+		return fmt.Errorf("condition on %v must have either below or above", c.Value)
+	}
+	if c.Hysteresis < 0 || c.For < 0 {
+		return fmt.Errorf("hysteresis and duration of condition on %v must not be negative", c.Value)
+	}
+	return nil
+}
+
+// update evaluates the condition for the summary and returns true if it holds.
+// Conditions on values the plant doesn't have, e.g. the SoC of a plant without batteries, never hold.
+func (c *Condition) update(s plant.Summary) bool {
+	v, ok := value(s, c.Value)
+	if !ok {
+		c.met = false
+		return false
+	}
+
+	var met bool
+	if c.Below != nil {
+		threshold := *c.Below
+		if c.met {
+			threshold += c.Hysteresis
+		}
+		met = v < threshold
+	} else {
+		threshold := *c.Above
+		if c.met {
+			threshold -= c.Hysteresis
+		}
+		met = v > threshold
+	}
+
+	if met && !c.met {
+		c.since = s.TimestampEnd
+	}
+	c.met = met
+	return met && s.TimestampEnd.Sub(c.since) >= c.For
+}
+
+func value(s plant.Summary, name string) (float64, bool) {
+	switch name {
+	case ValueGrid:
+		return float64(s.Grid), s.HasGrid
+	case ValuePV:
+		return float64(s.PV), true
+	case ValueBattery:
+		return float64(s.Bat), s.HasBattery
+	case ValueBatterySoC:
+		return float64(s.BatPercentage), s.HasBattery
+	case ValueSelfConsumption:
+		return float64(s.SelfConsumption), s.HasGrid
+	default:
+		return 0, false
+	}
+}
+
+// Rule switches an actuator on while all of its conditions hold, and off otherwise.
+//
+// The rule is evaluated at the timestamps of the summaries, so a rule switches at most once per summary. As the state
+// of the actuator is unknown at first, the first evaluation always switches it.
+type Rule struct {
+	Name       string
+	Conditions []Condition
+	// MinOn and MinOff are the minimum times the actuator stays switched on or off.
+	MinOn, MinOff time.Duration
+	Actuator      Actuator
+
+	known   bool
+	on      bool
+	changed time.Time
+	// failures is the number of failed switches since the last successful one, retried after retryAt.
+	failures int
+	retryAt  time.Time
+}
+
+// Validate returns an error if the rule or one of its conditions is incomplete.
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule has no name")
+	}
+	if len(r.Conditions) == 0 {
+		return fmt.Errorf("rule %v has no conditions", r.Name)
+	}
+	for i := range r.Conditions {
+		err := r.Conditions[i].Validate()
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("rule %v", r.Name))
+		}
+	}
+	if r.Actuator == nil {
+		return fmt.Errorf("rule %v has no actuator", r.Name)
+	}
+	return nil
+}
+
+// Evaluate updates the conditions with the summary and switches the actuator if needed.
+// It returns true if the actuator was switched. If switching fails, it is retried with exponential backoff.
+func (r *Rule) Evaluate(ctx context.Context, s plant.Summary) (bool, error) {
+	if s.Stale {
+		return false, nil
+	}
+
+	on := true
+	// all conditions are updated to keep track of the time they are met
+	for i := range r.Conditions {
+		if !r.Conditions[i].update(s) {
+			on = false
+		}
+	}
+
+	if r.known {
+		if on == r.on {
+			return false, nil
+		}
+
+		min := r.MinOff
+		if r.on {
+			min = r.MinOn
+		}
+		if s.TimestampEnd.Sub(r.changed) < min {
+			return false, nil
+		}
+	}
+	if s.TimestampEnd.Before(r.retryAt) {
+		return false, nil
+	}
+
+	err := r.Actuator.Switch(ctx, on)
+	if err != nil {
+		r.retryAt = s.TimestampEnd.Add(retryDelay(r.failures))
+		r.failures++
+		return false, errors.Wrap(err, fmt.Sprintf("error switching %v %v, retrying after %v", r.Name, state(on),
+			r.retryAt.Sub(s.TimestampEnd)))
+	}
+
+	r.known, r.on, r.changed = true, on, s.TimestampEnd
+	r.failures, r.retryAt = 0, time.Time{}
+	return true, nil
+}
+
+// SwitchOff switches the actuator off unless it is known to be off, e.g. once the summaries of the plant stopped. The
+// conditions are reset, so their durations start again with the next summary. It returns true if the actuator was
+// switched.
+func (r *Rule) SwitchOff(ctx context.Context, now time.Time) (bool, error) {
+	for i := range r.Conditions {
+		r.Conditions[i].met = false
+	}
+
+	if r.known && !r.on {
+		return false, nil
+	}
+
+	err := r.Actuator.Switch(ctx, false)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("error switching %v off", r.Name))
+	}
+
+	r.known, r.on, r.changed = true, false, now
+	r.failures, r.retryAt = 0, time.Time{}
+	return true, nil
+}
+
+// Run evaluates the rules of each plant on every new summary until ctx is done.
+//
+// If a plant has no fresh summary for its duration in staleAfter, e.g. because its meter is offline, its rules are
+// switched off until fresh summaries arrive again. Plants without a duration aren't watched.
+func Run(ctx context.Context, rules map[string][]*Rule, plants map[string]plant.Subscriber,
+	staleAfter map[string]time.Duration) {
+	for k, v := range rules {
+		go func(name string, rules []*Rule) {
+			summaries, unsubscribe := plants[name].Subscribe()
+			defer unsubscribe()
+
+			var (
+				watchdog *time.Timer
+				expired  <-chan time.Time
+				// last is the timestamp of the last fresh summary, received at lastAt
+				last, lastAt time.Time
+			)
+			if d := staleAfter[name]; d > 0 {
+				watchdog = time.NewTimer(d)
+				defer watchdog.Stop()
+				expired = watchdog.C
+			}
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-expired:
+					// rules are evaluated at the timestamps of the summaries
+					ts := last.Add(now.Sub(lastAt))
+					for _, r := range rules {
+						switched, err := r.SwitchOff(ctx, ts)
+						if err != nil {
+							log.Println(errors.Wrap(err, fmt.Sprintf("plant %v", name)))
+						} else if switched {
+							log.Printf("switched %v of plant %v off, summaries are stale", r.Name, name)
+						}
+					}
+					// switching off is retried until fresh summaries arrive
+					watchdog.Reset(staleAfter[name])
+				case s, ok := <-summaries:
+					if !ok {
+						return
+					}
+					if watchdog != nil && !s.Stale {
+						last, lastAt = s.TimestampEnd, time.Now()
+						if !watchdog.Stop() {
+							<-watchdog.C
+						}
+						watchdog.Reset(staleAfter[name])
+					}
+					for _, r := range rules {
+						switched, err := r.Evaluate(ctx, s)
+						if err != nil {
+							log.Println(errors.Wrap(err, fmt.Sprintf("plant %v", name)))
+						} else if switched {
+							log.Printf("switched %v of plant %v %v", r.Name, name, state(r.on))
+						}
+					}
+				}
+			}
+		}(k, v)
+	}
+}
+
+func state(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// retryDelay returns the delay before retrying a switch which failed the given number of times before.
+func retryDelay(failures int) time.Duration {
+	if failures >= 16 {
+		return retryDelayMax
+	}
+	if d := retryDelayStart << uint(failures); d < retryDelayMax {
+		return d
+	}
+	return retryDelayMax
+}
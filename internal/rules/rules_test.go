@@ -0,0 +1,344 @@
+package rules
+
+import (
+	"context"
+	"github.com/orlopau/go-sma-api/internal/plant"
+	"github.com/pkg/errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type dummyActuator struct {
+	err error
+
+	m        sync.Mutex
+	switches []bool
+}
+
+func (d *dummyActuator) Switch(ctx context.Context, on bool) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	d.switches = append(d.switches, on)
+	return nil
+}
+
+func (d *dummyActuator) get() []bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return append([]bool(nil), d.switches...)
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+var start = time.Unix(1608579392, 0)
+
+// summaries returns summaries of the grid power and SoC, one per second.
+func summaries(values ...[2]float32) []plant.Summary {
+	ss := make([]plant.Summary, len(values))
+	for i, v := range values {
+		ss[i] = plant.Summary{
+			Grid:          v[0],
+			BatPercentage: uint(v[1]),
+			HasGrid:       true,
+			HasBattery:    true,
+			TimestampEnd:  start.Add(time.Duration(i) * time.Second),
+		}
+	}
+	return ss
+}
+
+func TestRule_Evaluate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		rule      Rule
+		summaries []plant.Summary
+		ex        []bool
+	}{
+		{
+			name: "SwitchesInitially",
+			rule: Rule{Conditions: []Condition{{Value: ValueGrid, Below: float(-1500)}}},
+			summaries: summaries(
+				[2]float32{0, 0},
+				[2]float32{0, 0},
+			),
+			ex: []bool{false},
+		},
+		{
+			name: "AllConditions",
+			rule: Rule{Conditions: []Condition{
+				{Value: ValueGrid, Below: float(-1500)},
+				{Value: ValueBatterySoC, Above: float(80)},
+			}},
+			summaries: summaries(
+				[2]float32{-2000, 70},
+				[2]float32{-2000, 90},
+				[2]float32{-1000, 90},
+			),
+			ex: []bool{false, true, false},
+		},
+		{
+			name: "Duration",
+			rule: Rule{Conditions: []Condition{{Value: ValueGrid, Below: float(-1500), For: 2 * time.Second}}},
+			summaries: summaries(
+				[2]float32{-2000, 0},
+				[2]float32{-2000, 0},
+				// interrupted, the duration starts again
+				[2]float32{0, 0},
+				[2]float32{-2000, 0},
+				[2]float32{-2000, 0},
+				[2]float32{-2000, 0},
+			),
+			ex: []bool{false, true},
+		},
+		{
+			name: "Hysteresis",
+			rule: Rule{Conditions: []Condition{{Value: ValueGrid, Below: float(-1500), Hysteresis: 1000}}},
+			summaries: summaries(
+				[2]float32{-1000, 0},
+				[2]float32{-1600, 0},
+				// the load is switched on, met until above -500
+				[2]float32{-600, 0},
+				[2]float32{-400, 0},
+				[2]float32{-1000, 0},
+			),
+			ex: []bool{false, true, false},
+		},
+		{
+			name: "HysteresisAbove",
+			rule: Rule{Conditions: []Condition{{Value: ValueBatterySoC, Above: float(80), Hysteresis: 10}}},
+			summaries: summaries(
+				[2]float32{0, 85},
+				[2]float32{0, 75},
+				[2]float32{0, 70},
+			),
+			ex: []bool{true, false},
+		},
+		{
+			name: "MinOnAndOff",
+			rule: Rule{
+				Conditions: []Condition{{Value: ValueGrid, Below: float(-1500)}},
+				MinOn:      2 * time.Second,
+				MinOff:     3 * time.Second,
+			},
+			summaries: summaries(
+				[2]float32{-2000, 0},
+				[2]float32{0, 0},
+				[2]float32{0, 0},
+				[2]float32{-2000, 0},
+				[2]float32{-2000, 0},
+				[2]float32{-2000, 0},
+			),
+			// on at 0s, off at 2s, on at 5s
+			ex: []bool{true, false, true},
+		},
+		{
+			name: "MissingValue",
+			rule: Rule{Conditions: []Condition{{Value: ValueGrid, Above: float(-1)}}},
+			summaries: []plant.Summary{
+				{TimestampEnd: start},
+			},
+			ex: []bool{false},
+		},
+		{
+			name: "StaleSummary",
+			rule: Rule{Conditions: []Condition{{Value: ValueGrid, Below: float(0)}}},
+			summaries: []plant.Summary{
+				{HasGrid: true, Grid: -100, Stale: true, TimestampEnd: start},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			a := &dummyActuator{}
+			tt.rule.Name = tt.name
+			tt.rule.Actuator = a
+			err := tt.rule.Validate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, s := range tt.summaries {
+				_, err := tt.rule.Evaluate(context.Background(), s)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if switches := a.get(); !reflect.DeepEqual(switches, tt.ex) {
+				t.Fatalf("expected switches %v, got %v", tt.ex, switches)
+			}
+		})
+	}
+}
+
+func TestRule_Evaluate_retry(t *testing.T) {
+	t.Parallel()
+
+	a := &dummyActuator{err: errors.New("offline")}
+	r := Rule{Name: "retry", Conditions: []Condition{{Value: ValuePV, Above: float(100)}}, Actuator: a}
+
+	evaluate := func(offset time.Duration) (bool, error) {
+		return r.Evaluate(context.Background(), plant.Summary{PV: 200, TimestampEnd: start.Add(offset)})
+	}
+
+	if _, err := evaluate(0); err == nil {
+		t.Fatal("expected error")
+	}
+	// not retried before the delay
+	if switched, err := evaluate(retryDelayStart - time.Second); switched || err != nil {
+		t.Fatalf("expected no retry, got switched %v, error %v", switched, err)
+	}
+	if _, err := evaluate(retryDelayStart); err == nil {
+		t.Fatal("expected error")
+	}
+	// the delay doubled
+	if switched, err := evaluate(2*retryDelayStart + time.Second); switched || err != nil {
+		t.Fatalf("expected no retry, got switched %v, error %v", switched, err)
+	}
+
+	a.m.Lock()
+	a.err = nil
+	a.m.Unlock()
+
+	switched, err := evaluate(3 * retryDelayStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !switched || !reflect.DeepEqual(a.get(), []bool{true}) {
+		t.Fatalf("expected switch to be retried, got %v", a.get())
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		failures int
+		ex       time.Duration
+	}{
+		{failures: 0, ex: retryDelayStart},
+		{failures: 1, ex: 2 * retryDelayStart},
+		{failures: 5, ex: 32 * retryDelayStart},
+		{failures: 6, ex: retryDelayMax},
+		{failures: 100, ex: retryDelayMax},
+	}
+
+	for _, tt := range tests {
+		if d := retryDelay(tt.failures); d != tt.ex {
+			t.Errorf("expected delay %v after %v failures, got %v", tt.ex, tt.failures, d)
+		}
+	}
+}
+
+func TestRule_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{name: "NoName", rule: Rule{Conditions: []Condition{{Value: ValuePV, Above: float(0)}}, Actuator: &dummyActuator{}}},
+		{name: "NoConditions", rule: Rule{Name: "r", Actuator: &dummyActuator{}}},
+		{name: "NoActuator", rule: Rule{Name: "r", Conditions: []Condition{{Value: ValuePV, Above: float(0)}}}},
+		{
+			name: "UnknownValue",
+			rule: Rule{Name: "r", Conditions: []Condition{{Value: "wind", Above: float(0)}}, Actuator: &dummyActuator{}},
+		},
+		{
+			name: "NoThreshold",
+			rule: Rule{Name: "r", Conditions: []Condition{{Value: ValuePV}}, Actuator: &dummyActuator{}},
+		},
+		{
+			name: "BothThresholds",
+			rule: Rule{
+				Name:       "r",
+				Conditions: []Condition{{Value: ValuePV, Above: float(0), Below: float(10)}},
+				Actuator:   &dummyActuator{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := tt.rule.Validate(); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+type dummySubscriber chan plant.Summary
+
+func (d dummySubscriber) Subscribe() (<-chan plant.Summary, func()) {
+	return d, func() {}
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	a := &dummyActuator{}
+	sub := make(dummySubscriber)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	Run(ctx, map[string][]*Rule{
+		"plant1": {{Name: "heater", Conditions: []Condition{{Value: ValuePV, Above: float(1000)}}, Actuator: a}},
+	}, map[string]plant.Subscriber{"plant1": sub}, nil)
+
+	sub <- plant.Summary{PV: 2000, TimestampEnd: start}
+	sub <- plant.Summary{PV: 0, TimestampEnd: start.Add(time.Second)}
+	// the previous summary is evaluated once the next one is received
+	sub <- plant.Summary{PV: 0, TimestampEnd: start.Add(2 * time.Second)}
+
+	if switches := a.get(); !reflect.DeepEqual(switches, []bool{true, false}) {
+		t.Fatalf("expected switches on and off, got %v", switches)
+	}
+}
+
+func TestRun_watchdog(t *testing.T) {
+	t.Parallel()
+
+	a := &dummyActuator{}
+	sub := make(dummySubscriber)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	Run(ctx, map[string][]*Rule{
+		"plant1": {{Name: "heater", Conditions: []Condition{{Value: ValuePV, Above: float(1000)}}, Actuator: a}},
+	}, map[string]plant.Subscriber{"plant1": sub}, map[string]time.Duration{"plant1": 50 * time.Millisecond})
+
+	sub <- plant.Summary{PV: 2000, TimestampEnd: start}
+	// stale summaries don't keep the rules running
+	for i := 1; i <= 10; i++ {
+		sub <- plant.Summary{PV: 2000, Stale: true, TimestampEnd: start.Add(time.Duration(i) * time.Second)}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if switches := a.get(); !reflect.DeepEqual(switches, []bool{true, false}) {
+		t.Fatalf("expected switches on and off, got %v", switches)
+	}
+
+	// the rules resume with fresh summaries
+	sub <- plant.Summary{PV: 2000, TimestampEnd: start.Add(11 * time.Second)}
+	sub <- plant.Summary{PV: 2000, TimestampEnd: start.Add(12 * time.Second)}
+
+	if switches := a.get(); !reflect.DeepEqual(switches, []bool{true, false, true}) {
+		t.Fatalf("expected switch on after fresh summaries, got %v", switches)
+	}
+}